@@ -37,6 +37,7 @@ func main() {
 	}
 
 	flag.StringVar(&cfg.StratumPort, "stratum", cfg.StratumPort, "stratum port to listen on")
+	flag.StringVar(&cfg.StratumTLSPort, "stratumtls", cfg.StratumTLSPort, "stratum+ssl port to listen on, requires tls_cert_file and tls_key_file")
 	flag.BoolVar(&cfg.PrintStats, "stats", cfg.PrintStats, "true to show periodic stats to console")
 	flag.StringVar(&cfg.RPCServer, "hoosat_address", cfg.RPCServer, "address of the spectred node")
 	flag.DurationVar(&cfg.BlockWaitTime, "blockwait", cfg.BlockWaitTime, "time in ms to wait before manually requesting new block")
@@ -49,6 +50,7 @@ func main() {
 	flag.StringVar(&cfg.PromPort, "prom", cfg.PromPort, "address to serve prom stats")
 	flag.BoolVar(&cfg.UseLogFile, "log", cfg.UseLogFile, "if true will output errors to log file")
 	flag.StringVar(&cfg.HealthCheckPort, "hcp", cfg.HealthCheckPort, "(rarely used) if defined will expose a health check on /readyz")
+	flag.BoolVar(&cfg.ProxyProtocol, "proxyprotocol", cfg.ProxyProtocol, "true to read HAProxy PROXY protocol headers from trusted sources")
 	flag.BoolVar(&cfg.MineWhenNotSynced, "minewhennotsynced", cfg.MineWhenNotSynced, "mine when not synced")
 	flag.Int64Var(&cfg.Poll, "poll", cfg.Poll, "Poll id for voting on blocks")
 	flag.Int64Var(&cfg.Vote, "vote", cfg.Vote, "Vote id of the poll for voting on blocks")
@@ -65,6 +67,11 @@ func main() {
 	log.Printf("initializing bridge")
 	log.Printf("hoosat:\t\t\t%s", cfg.RPCServer)
 	log.Printf("stratum:\t\t\t%s", cfg.StratumPort)
+	for _, port := range cfg.StratumPorts {
+		log.Printf("stratum port:\t\t%s", port.Port)
+	}
+	log.Printf("stratum tls:\t\t%s", cfg.StratumTLSPort)
+	log.Printf("proxy protocol:\t\t%t", cfg.ProxyProtocol)
 	log.Printf("prom:\t\t\t%s", cfg.PromPort)
 	log.Printf("stats:\t\t\t%t", cfg.PrintStats)
 	log.Printf("log:\t\t\t%t", cfg.UseLogFile)
@@ -0,0 +1,148 @@
+package gostratum
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+type RejectReason string
+
+const (
+	RejectGlobalLimit RejectReason = "global_limit"
+	RejectIPLimit     RejectReason = "ip_limit"
+	RejectRateLimit   RejectReason = "rate_limit"
+)
+
+// ConnectionLimits protects exposed listeners from scanners and floods. A
+// zero value for any limit disables it
+type ConnectionLimits struct {
+	MaxConnections      int     // max concurrent clients across all ips
+	MaxConnectionsPerIP int     // max concurrent clients from a single ip
+	ConnectRatePerIP    float64 // new connections per minute allowed from a single ip
+	ConnectBurstPerIP   int     // connections allowed in a burst before the rate kicks in
+}
+
+// StratumRejectListener can optionally be implemented by the ClientListener
+// to be told about connections refused due to ConnectionLimits
+type StratumRejectListener interface {
+	OnReject(addr string, reason RejectReason)
+}
+
+const limiterSweepInterval = time.Minute
+
+type ipConnections struct {
+	active     int
+	tokens     float64
+	lastRefill time.Time
+	warned     bool
+}
+
+// ConnectionLimiter enforces ConnectionLimits. Listeners given the same
+// limiter count against the same limits, so a bridge with several ports
+// still has a single global cap
+type ConnectionLimiter struct {
+	ConnectionLimits
+	lock      sync.Mutex
+	total     int
+	clients   map[string]*ipConnections
+	lastSweep time.Time
+	clock     func() time.Time
+}
+
+func NewConnectionLimiter(limits ConnectionLimits) *ConnectionLimiter {
+	if limits.ConnectRatePerIP > 0 && limits.ConnectBurstPerIP <= 0 {
+		limits.ConnectBurstPerIP = int(math.Max(1, math.Ceil(limits.ConnectRatePerIP)))
+	}
+	return &ConnectionLimiter{
+		ConnectionLimits: limits,
+		clients:          map[string]*ipConnections{},
+		clock:            time.Now,
+	}
+}
+
+// admit reserves a connection slot for the ip. On rejection the reason is
+// returned, along with whether this is the first rejection for the ip since
+// it was last seen behaving, so callers can log once per offender
+func (cl *ConnectionLimiter) admit(addr string) (RejectReason, bool) {
+	if cl.ConnectionLimits == (ConnectionLimits{}) {
+		return "", false
+	}
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	now := cl.clock()
+	if now.Sub(cl.lastSweep) > limiterSweepInterval {
+		cl.sweep(now)
+	}
+
+	client, exists := cl.clients[addr]
+	if !exists {
+		client = &ipConnections{
+			tokens:     float64(cl.ConnectBurstPerIP),
+			lastRefill: now,
+		}
+		cl.clients[addr] = client
+	}
+
+	var reason RejectReason
+	if cl.ConnectRatePerIP > 0 {
+		cl.refill(client, now)
+		if client.tokens < 1 {
+			reason = RejectRateLimit
+		} else {
+			// attempts count against the rate even if rejected below
+			client.tokens--
+		}
+	}
+	if reason == "" && cl.MaxConnectionsPerIP > 0 && client.active >= cl.MaxConnectionsPerIP {
+		reason = RejectIPLimit
+	}
+	if reason == "" && cl.MaxConnections > 0 && cl.total >= cl.MaxConnections {
+		reason = RejectGlobalLimit
+	}
+	if reason != "" {
+		first := !client.warned
+		client.warned = true
+		return reason, first
+	}
+
+	client.active++
+	cl.total++
+	return "", false
+}
+
+func (cl *ConnectionLimiter) release(addr string) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	client, exists := cl.clients[addr]
+	if !exists || client.active == 0 {
+		return // never admitted through the limiter
+	}
+	client.active--
+	cl.total--
+}
+
+func (cl *ConnectionLimiter) refill(client *ipConnections, now time.Time) {
+	elapsed := now.Sub(client.lastRefill).Minutes()
+	client.tokens = math.Min(float64(cl.ConnectBurstPerIP), client.tokens+elapsed*cl.ConnectRatePerIP)
+	client.lastRefill = now
+}
+
+// sweep drops idle ips that are back to a full bucket, which also resets the
+// once-per-offender warning
+func (cl *ConnectionLimiter) sweep(now time.Time) {
+	cl.lastSweep = now
+	for addr, client := range cl.clients {
+		if client.active > 0 {
+			continue
+		}
+		if cl.ConnectRatePerIP > 0 {
+			cl.refill(client, now)
+			if client.tokens < float64(cl.ConnectBurstPerIP) {
+				continue
+			}
+		}
+		delete(cl.clients, addr)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/Hoosat-Oy/HTND/util"
 	"github.com/mattn/go-colorable"
@@ -18,6 +20,8 @@ const (
 	StratumMethodSubscribe StratumMethod = "mining.subscribe"
 	StratumMethodAuthorize StratumMethod = "mining.authorize"
 	StratumMethodSubmit    StratumMethod = "mining.submit"
+
+	StratumMethodExtranonceSubscribe StratumMethod = "mining.extranonce.subscribe"
 )
 
 func DefaultLogger() *zap.Logger {
@@ -44,16 +48,20 @@ func DefaultHandlers() StratumHandlerMap {
 		string(StratumMethodSubscribe): HandleSubscribe,
 		string(StratumMethodAuthorize): HandleAuthorize,
 		string(StratumMethodSubmit):    HandleSubmit,
+
+		string(StratumMethodExtranonceSubscribe): HandleExtranonceSubscribe,
 	}
 }
 
-func HandleAuthorize(ctx *StratumContext, event JsonRpcEvent) error {
+// ParseAuthorizeParams extracts the wallet and worker name from the
+// `wallet.worker` login sent with mining.authorize
+func ParseAuthorizeParams(event JsonRpcEvent) (string, string, error) {
 	if len(event.Params) < 1 {
-		return fmt.Errorf("malformed event from miner, expected param[1] to be address")
+		return "", "", fmt.Errorf("malformed event from miner, expected param[1] to be address")
 	}
 	address, ok := event.Params[0].(string)
 	if !ok {
-		return fmt.Errorf("malformed event from miner, expected param[1] to be address string")
+		return "", "", fmt.Errorf("malformed event from miner, expected param[1] to be address string")
 	}
 	parts := strings.Split(address, ".")
 	var workerName string
@@ -61,10 +69,17 @@ func HandleAuthorize(ctx *StratumContext, event JsonRpcEvent) error {
 		address = parts[0]
 		workerName = parts[1]
 	}
-	var err error
-	address, err = CleanWallet(address)
+	cleaned, err := CleanWallet(address)
 	if err != nil {
-		return fmt.Errorf("invalid wallet format %s: %w", address, err)
+		return "", "", fmt.Errorf("invalid wallet format %s: %w", address, err)
+	}
+	return cleaned, workerName, nil
+}
+
+func HandleAuthorize(ctx *StratumContext, event JsonRpcEvent) error {
+	address, workerName, err := ParseAuthorizeParams(event)
+	if err != nil {
+		return err
 	}
 
 	ctx.WalletAddr = address
@@ -82,17 +97,39 @@ func HandleAuthorize(ctx *StratumContext, event JsonRpcEvent) error {
 	return nil
 }
 
-func HandleSubscribe(ctx *StratumContext, event JsonRpcEvent) error {
-	if err := ctx.Reply(NewResponse(event,
-		[]any{true, "EthereumStratum/1.0.0"}, nil)); err != nil {
-		return errors.Wrap(err, "failed to send response to subscribe")
-	}
+// ParseSubscribeParams extracts the miner's user agent from mining.subscribe,
+// along with the session id a reconnecting miner may send as the second param
+func ParseSubscribeParams(event JsonRpcEvent) (string, string) {
+	var app, session string
 	if len(event.Params) > 0 {
-		app, ok := event.Params[0].(string)
-		if ok {
-			ctx.RemoteApp = app
+		app, _ = event.Params[0].(string)
+	}
+	if len(event.Params) > 1 {
+		session, _ = event.Params[1].(string)
+		if strings.HasPrefix(session, "EthereumStratum") {
+			session = "" // protocol version, not a session
 		}
 	}
+	return app, session
+}
+
+func HandleSubscribe(ctx *StratumContext, event JsonRpcEvent) error {
+	if app, _ := ParseSubscribeParams(event); app != "" {
+		ctx.RemoteApp = app
+	}
+	result := []any{true, "EthereumStratum/1.0.0"}
+	if ctx.Extranonce != "" || ctx.SessionId != "" {
+		// miners that need the extranonce before their first job can take it
+		// from here rather than waiting for set_extranonce
+		result = append(result, ctx.Extranonce, len(ctx.Extranonce)/2)
+	}
+	if ctx.SessionId != "" {
+		// presented as the second subscribe param to resume the session
+		result = append(result, ctx.SessionId)
+	}
+	if err := ctx.Reply(NewResponse(event, result, nil)); err != nil {
+		return errors.Wrap(err, "failed to send response to subscribe")
+	}
 
 	ctx.Logger.Info("client subscribed ", zap.Any("context", ctx))
 	return nil
@@ -104,6 +141,30 @@ func HandleSubmit(ctx *StratumContext, event JsonRpcEvent) error {
 	return nil
 }
 
+// HandleExtranonceSubscribe records that the miner accepts extranonce changes
+// mid-session via mining.set_extranonce
+func HandleExtranonceSubscribe(ctx *StratumContext, event JsonRpcEvent) error {
+	atomic.StoreInt32(&ctx.extranonceSubscribed, 1)
+	if err := ctx.Reply(NewResponse(event, true, nil)); err != nil {
+		return errors.Wrap(err, "failed to send response to extranonce subscribe")
+	}
+	return nil
+}
+
+// SetExtranonce assigns a new extranonce to a connected miner. Miners that
+// sent mining.extranonce.subscribe are told with mining.set_extranonce, the
+// rest only get the legacy set_extranonce once authorized
+func SetExtranonce(ctx *StratumContext, extranonce string) error {
+	ctx.Extranonce = extranonce
+	if ctx.ExtranonceSubscribed() {
+		return ctx.Send(NewEvent("", "mining.set_extranonce", []any{extranonce, len(extranonce) / 2}))
+	}
+	if ctx.Authorized() {
+		return ctx.Send(NewEvent("", "set_extranonce", []any{extranonce}))
+	}
+	return nil
+}
+
 func SendExtranonce(ctx *StratumContext) {
 	if err := ctx.Send(NewEvent("", "set_extranonce", []any{ctx.Extranonce})); err != nil {
 		// should we doing anything further on failure
@@ -111,6 +172,24 @@ func SendExtranonce(ctx *StratumContext) {
 	}
 }
 
+// SendMessage displays a message in the miner's console, for those that
+// support client.show_message
+func SendMessage(ctx *StratumContext, message string) {
+	if err := ctx.Send(NewEvent("", "client.show_message", []any{message})); err != nil {
+		ctx.Logger.Error(errors.Wrap(err, "failed to send message").Error(), zap.Any("context", ctx))
+	}
+}
+
+// SendReconnect asks the miner to reconnect after wait, to host:port if given
+// or to the same server otherwise
+func SendReconnect(ctx *StratumContext, host string, port string, wait time.Duration) error {
+	params := []any{}
+	if host != "" {
+		params = append(params, host, port, int(wait.Seconds()))
+	}
+	return ctx.Send(NewEvent("", "client.reconnect", params))
+}
+
 var walletRegex = regexp.MustCompile("(hoosat|hoosattest):[a-z0-9]+")
 
 func CleanWallet(in string) (string, error) {
@@ -10,10 +10,11 @@ import (
 )
 
 type MockConnection struct {
-	id      string
-	lock    sync.Mutex // to prevent double closing of channel
-	inChan  chan []byte
-	outChan chan []byte
+	id         string
+	remoteAddr string
+	lock       sync.Mutex // to prevent double closing of channel
+	inChan     chan []byte
+	outChan    chan []byte
 }
 
 var channelCounter int32
@@ -27,6 +28,14 @@ func NewMockConnection() *MockConnection {
 	}
 }
 
+// NewMockConnectionFromAddr creates a mock connection that reports the given
+// remote address (e.g. `[2001:db8::1]:5555`) rather than the connection id
+func NewMockConnectionFromAddr(addr string) *MockConnection {
+	mc := NewMockConnection()
+	mc.remoteAddr = addr
+	return mc
+}
+
 func (mc *MockConnection) AsyncWriteTestDataToReadBuffer(s string) {
 	go func() {
 		mc.inChan <- []byte(s)
@@ -78,6 +87,9 @@ func (mc *MockConnection) LocalAddr() net.Addr {
 }
 
 func (mc *MockConnection) RemoteAddr() net.Addr {
+	if mc.remoteAddr != "" {
+		return MockAddr{id: mc.remoteAddr}
+	}
 	return MockAddr{id: mc.id}
 }
 
@@ -0,0 +1,35 @@
+package gostratum
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// ClientAddr returns the normalized host portion of a connection's remote
+// address, which is what's used for logging, stats keys and metrics labels
+func ClientAddr(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		if ip, ok := netip.AddrFromSlice(tcpAddr.IP); ok {
+			return ip.Unmap().WithZone(tcpAddr.Zone).String()
+		}
+	}
+	return NormalizeHost(addr.String())
+}
+
+// NormalizeHost strips the port (if any) from an address and canonicalizes
+// the ip, so `[2001:DB8::0:1]:5555`, `2001:db8::1` and `::ffff:10.0.0.1` style
+// inputs all map to a single consistent representation. Anything that isn't
+// an ip is returned as is
+func NormalizeHost(addr string) string {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	} else {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return ip.Unmap().String()
+	}
+	return host
+}
@@ -0,0 +1,213 @@
+package gostratum
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const proxyHeaderTimeout = 10 * time.Second
+
+// v1 headers are at most 107 bytes including the trailing CRLF
+const proxyV1MaxLength = 107
+
+// v2 headers carry optional TLVs after the addresses, cap them to something sane
+const proxyV2MaxLength = 4096
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var ErrProxyHeader = fmt.Errorf("invalid proxy protocol header")
+
+// proxyConn replays anything buffered while reading the proxy header and
+// reports the original client address instead of the load balancer's
+type proxyConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (pc *proxyConn) Read(b []byte) (int, error) {
+	return pc.reader.Read(b)
+}
+
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	return pc.remoteAddr
+}
+
+func parseTrustedCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") { // bare ip, trust just that host
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy trusted address %s", cidr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid proxy trusted cidr %s", cidr)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// isProxyTrusted says whether the connection comes from one of the trusted
+// proxies, with none configured nobody is
+func (s *StratumListener) isProxyTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range s.proxyTrusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader consumes a PROXY v1 or v2 header from the connection. LOCAL
+// and UNKNOWN headers (e.g. load balancer health checks) keep the address of
+// the connection itself
+func readProxyHeader(connection net.Conn) (net.Conn, error) {
+	if err := connection.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(connection)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed reading proxy header")
+	}
+
+	var addr net.Addr
+	switch first[0] {
+	case 'P':
+		addr, err = parseProxyV1(reader)
+	case proxyV2Signature[0]:
+		addr, err = parseProxyV2(reader)
+	default:
+		err = errors.Wrap(ErrProxyHeader, "no proxy header sent by trusted source")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if addr == nil {
+		addr = connection.RemoteAddr()
+	}
+	if err := connection.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return &proxyConn{
+		Conn:       connection,
+		reader:     reader,
+		remoteAddr: addr,
+	}, nil
+}
+
+func parseProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed reading proxy v1 header")
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.Wrap(ErrProxyHeader, "v1 header not terminated")
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.Wrapf(ErrProxyHeader, "malformed v1 header %q", line)
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, errors.Wrapf(ErrProxyHeader, "unsupported v1 protocol %s", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, errors.Wrapf(ErrProxyHeader, "malformed v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, errors.Wrapf(ErrProxyHeader, "invalid v1 source address %s", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errors.Wrapf(ErrProxyHeader, "invalid v1 source port %s", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func parseProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, errors.Wrap(err, "failed reading proxy v2 header")
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		return nil, errors.Wrap(ErrProxyHeader, "bad v2 signature")
+	}
+	if header[12]>>4 != 2 {
+		return nil, errors.Wrapf(ErrProxyHeader, "unsupported v2 version %d", header[12]>>4)
+	}
+	command := header[12] & 0xf
+	family := header[13] >> 4
+	length := binary.BigEndian.Uint16(header[14:16])
+	if length > proxyV2MaxLength {
+		return nil, errors.Wrapf(ErrProxyHeader, "v2 header too long (%d bytes)", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, errors.Wrap(err, "failed reading proxy v2 addresses")
+	}
+
+	switch command {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, errors.Wrapf(ErrProxyHeader, "unsupported v2 command %d", command)
+	}
+	switch family {
+	case 0x1: // AF_INET
+		if len(payload) < 12 {
+			return nil, errors.Wrap(ErrProxyHeader, "short v2 ipv4 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 0x2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, errors.Wrap(ErrProxyHeader, "short v2 ipv6 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	}
+	// AF_UNSPEC/AF_UNIX carry nothing useful for us
+	return nil, nil
+}
@@ -1,64 +1,156 @@
-package gostratum
-
-import (
-	"bufio"
-	"bytes"
-	"net"
-	"os"
-	"strings"
-	"time"
-
-	"github.com/pkg/errors"
-	"go.uber.org/zap"
-)
-
-func spawnClientListener(ctx *StratumContext, connection net.Conn, s *StratumListener) error {
-	defer ctx.Disconnect()
-
-	for {
-		err := readFromConnection(connection, func(line string) error {
-			event, err := UnmarshalEvent(line)
-			if err != nil {
-				ctx.Logger.Error("error unmarshalling event", zap.String("raw", line))
-				return err
-			}
-			return s.HandleEvent(ctx, event)
-		})
-		if errors.Is(err, os.ErrDeadlineExceeded) {
-			continue // expected timeout
-		}
-		if ctx.Err() != nil {
-			return ctx.Err() // context cancelled
-		}
-		if ctx.parentContext.Err() != nil {
-			return ctx.parentContext.Err() // parent context cancelled
-		}
-		if err != nil { // actual error
-			ctx.Logger.Error("error reading from socket", zap.Error(err))
-			return err
-		}
-	}
-}
-
-type LineCallback func(line string) error
-
-func readFromConnection(connection net.Conn, cb LineCallback) error {
-	deadline := time.Now().Add(5 * time.Second).UTC()
-	if err := connection.SetReadDeadline(deadline); err != nil {
-		return err
-	}
-
-	buffer := make([]byte, 8096*2)
-	_, err := connection.Read(buffer)
-	if err != nil {
-		return errors.Wrapf(err, "error reading from connection")
-	}
-	buffer = bytes.ReplaceAll(buffer, []byte("\x00"), nil)
-	scanner := bufio.NewScanner(strings.NewReader(string(buffer)))
-	for scanner.Scan() {
-		if err := cb(scanner.Text()); err != nil {
-			return err
-		}
-	}
-	return nil
-}
+package gostratum
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// DefaultMaxLineLength is the largest single jsonrpc message (in bytes,
+// excluding the newline) accepted from a client when the listener config
+// doesn't specify one
+const DefaultMaxLineLength = 16 * 1024
+
+const readTimeout = 5 * time.Second
+
+// ErrFraming is returned when the client sends data that can't be split into
+// newline delimited messages, e.g. a line exceeding the max line length
+var ErrFraming = fmt.Errorf("stratum framing error")
+
+// errHandler wraps failures decoding or handling a message, as opposed to
+// failures reading from the socket
+var errHandler = fmt.Errorf("stratum protocol error")
+
+func spawnClientListener(ctx *StratumContext, connection net.Conn, s *StratumListener) error {
+	reason, err := readClient(ctx, connection, s)
+	ctx.DisconnectWithReason(reason)
+	return err
+}
+
+// readClient processes messages until the client has to be dropped, returning
+// the reason why
+func readClient(ctx *StratumContext, connection net.Conn, s *StratumListener) (DisconnectReason, error) {
+	reader := newLineReader(connection, s.MaxLineLength)
+	for {
+		if reason := s.checkTimeouts(ctx, time.Now()); reason != "" {
+			ctx.Logger.Warn(fmt.Sprintf("client timed out: %s", reason))
+			return reason, nil
+		}
+		err := reader.readLines(func(line string) error {
+			event, err := UnmarshalEvent(line)
+			if err != nil {
+				ctx.Logger.Error("error unmarshalling event", zap.String("raw", line))
+				if listener, ok := s.ClientListener.(StratumMalformedListener); ok {
+					listener.OnMalformed(ctx, err)
+				}
+				return fmt.Errorf("%w: %s", errHandler, err)
+			}
+			if err := s.HandleEvent(ctx, event); err != nil {
+				return fmt.Errorf("%w: %s", errHandler, err)
+			}
+			return nil
+		})
+		if ctx.parentContext.Err() != nil {
+			return DisconnectServerShutdown, ctx.parentContext.Err() // parent context cancelled
+		}
+		if ctx.Err() != nil {
+			return DisconnectKicked, ctx.Err() // context cancelled
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue // expected timeout
+		}
+		if errors.Is(err, ErrFraming) {
+			ctx.Logger.Error("framing error reading from socket", zap.Error(err))
+			return DisconnectFramingError, err
+		}
+		if errors.Is(err, errHandler) {
+			ctx.Logger.Error("error handling message", zap.Error(err))
+			return DisconnectProtocolError, err
+		}
+		if errors.Is(err, io.EOF) {
+			return DisconnectClientClosed, err
+		}
+		if err != nil { // actual error
+			ctx.Logger.Error("error reading from socket", zap.Error(err))
+			return DisconnectSocketError, err
+		}
+	}
+}
+
+type LineCallback func(line string) error
+
+// lineReader reassembles newline delimited messages from a connection. The
+// buffer is allocated once per connection and any partial line left over
+// from a read is kept until the rest of it arrives. A message is only
+// delivered once its newline is read, a trailing message without one is
+// never delivered, as stratum requires every message to end in a newline
+type lineReader struct {
+	connection    net.Conn
+	buffer        []byte
+	start         int
+	end           int
+	maxLineLength int
+}
+
+func newLineReader(connection net.Conn, maxLineLength int) *lineReader {
+	if maxLineLength <= 0 {
+		maxLineLength = DefaultMaxLineLength
+	}
+	return &lineReader{
+		connection:    connection,
+		buffer:        make([]byte, maxLineLength+1), // +1 for the newline
+		maxLineLength: maxLineLength,
+	}
+}
+
+// readLines performs a single read from the connection and calls cb for
+// every complete line that is now buffered
+func (lr *lineReader) readLines(cb LineCallback) error {
+	if lr.start > 0 { // shift the partial line to the front of the buffer
+		lr.end = copy(lr.buffer, lr.buffer[lr.start:lr.end])
+		lr.start = 0
+	}
+	if lr.end == len(lr.buffer) {
+		return errors.Wrapf(ErrFraming, "line exceeds max length of %d bytes", lr.maxLineLength)
+	}
+
+	deadline := time.Now().Add(readTimeout).UTC()
+	if err := lr.connection.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	n, err := lr.connection.Read(lr.buffer[lr.end:])
+	lr.end += n
+	// deliver whatever arrived even if the read also errored
+	if cbErr := lr.drain(cb); cbErr != nil {
+		return cbErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error reading from connection")
+	}
+	return nil
+}
+
+func (lr *lineReader) drain(cb LineCallback) error {
+	for {
+		idx := bytes.IndexByte(lr.buffer[lr.start:lr.end], '\n')
+		if idx < 0 {
+			return nil
+		}
+		line := lr.buffer[lr.start : lr.start+idx]
+		lr.start += idx + 1
+		line = bytes.ReplaceAll(line, []byte("\x00"), nil)
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if err := cb(string(line)); err != nil {
+			return err
+		}
+	}
+}
@@ -2,9 +2,11 @@ package gostratum
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -15,6 +17,8 @@ import (
 
 type StratumContext struct {
 	parentContext context.Context
+	clientContext context.Context // cancelled on disconnect or parent shutdown
+	cancel        context.CancelFunc
 	RemoteAddr    string
 	WalletAddr    string
 	WorkerName    string
@@ -22,13 +26,41 @@ type StratumContext struct {
 	Id            int32
 	Logger        *zap.Logger
 	connection    net.Conn
-	disconnecting bool
+	disconnecting int32
 	onDisconnect  chan *StratumContext
 	State         any // gross, but go generics aren't mature enough this can be typed 😭
-	writeLock     int32
+	queue         *writeQueue
+	queueOnce     sync.Once
+	maxQueueDepth int
 	Extranonce    string
+	SessionId     string               // set by the application if it supports resuming sessions
+	TLS           *tls.ConnectionState `json:"-"` // handshake details, nil for plain tcp clients
+	connectTime   time.Time
+	lastMessage   int64 // unix nanos, accessed atomically
+	subscribed    int32
+	authorized    int32
+	reason        DisconnectReason
+
+	extranonceSubscribed int32 // set once the miner sends mining.extranonce.subscribe
 }
 
+// DisconnectReason describes why a client was disconnected, so listeners and
+// metrics can tell timeouts apart from socket errors
+type DisconnectReason string
+
+const (
+	DisconnectClientClosed     DisconnectReason = "client_closed"
+	DisconnectSocketError      DisconnectReason = "socket_error"
+	DisconnectFramingError     DisconnectReason = "framing_error"
+	DisconnectProtocolError    DisconnectReason = "protocol_error"
+	DisconnectSubscribeTimeout DisconnectReason = "subscribe_timeout"
+	DisconnectAuthorizeTimeout DisconnectReason = "authorize_timeout"
+	DisconnectIdleTimeout      DisconnectReason = "idle_timeout"
+	DisconnectServerShutdown   DisconnectReason = "server_shutdown"
+	DisconnectSlowConsumer     DisconnectReason = "slow_consumer"
+	DisconnectKicked           DisconnectReason = "kicked" // booted by the application
+)
+
 type ContextSummary struct {
 	RemoteAddr string
 	WalletAddr string
@@ -39,7 +71,32 @@ type ContextSummary struct {
 var ErrorDisconnected = fmt.Errorf("disconnecting")
 
 func (sc *StratumContext) Connected() bool {
-	return !sc.disconnecting
+	return atomic.LoadInt32(&sc.disconnecting) == 0
+}
+
+// DisconnectReason is only meaningful once the client has disconnected
+func (sc *StratumContext) DisconnectReason() DisconnectReason {
+	return sc.reason
+}
+
+func (sc *StratumContext) touch() {
+	atomic.StoreInt64(&sc.lastMessage, time.Now().UnixNano())
+}
+
+func (sc *StratumContext) LastMessage() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&sc.lastMessage))
+}
+
+func (sc *StratumContext) Subscribed() bool {
+	return atomic.LoadInt32(&sc.subscribed) == 1
+}
+
+func (sc *StratumContext) Authorized() bool {
+	return atomic.LoadInt32(&sc.authorized) == 1
+}
+
+func (sc *StratumContext) ExtranonceSubscribed() bool {
+	return atomic.LoadInt32(&sc.extranonceSubscribed) == 1
 }
 
 func (sc *StratumContext) Summary() ContextSummary {
@@ -53,8 +110,11 @@ func (sc *StratumContext) Summary() ContextSummary {
 
 func NewMockContext(ctx context.Context, logger *zap.Logger, state any) (*StratumContext, *MockConnection) {
 	mc := NewMockConnection()
+	clientContext, cancel := context.WithCancel(ctx)
 	return &StratumContext{
 		parentContext: ctx,
+		clientContext: clientContext,
+		cancel:        cancel,
 		State:         state,
 		RemoteAddr:    "127.0.0.1",
 		WalletAddr:    uuid.NewString(),
@@ -71,7 +131,7 @@ func (sc *StratumContext) String() string {
 }
 
 func (sc *StratumContext) Reply(response JsonRpcResponse) error {
-	if sc.disconnecting {
+	if !sc.Connected() {
 		return ErrorDisconnected
 	}
 	encoded, err := json.Marshal(response)
@@ -79,11 +139,11 @@ func (sc *StratumContext) Reply(response JsonRpcResponse) error {
 		return errors.Wrap(err, "failed encoding jsonrpc response")
 	}
 	encoded = append(encoded, '\n')
-	return sc.writeWithBackoff(encoded)
+	return sc.enqueue(outboundMessage{data: encoded})
 }
 
 func (sc *StratumContext) Send(event JsonRpcEvent) error {
-	if sc.disconnecting {
+	if !sc.Connected() {
 		return ErrorDisconnected
 	}
 	encoded, err := json.Marshal(event)
@@ -91,42 +151,74 @@ func (sc *StratumContext) Send(event JsonRpcEvent) error {
 		return errors.Wrap(err, "failed encoding jsonrpc event")
 	}
 	encoded = append(encoded, '\n')
-	return sc.writeWithBackoff(encoded)
+	return sc.enqueue(outboundMessage{
+		data: encoded,
+		job:  event.Method == "mining.notify",
+	})
 }
 
-var errWriteBlocked = fmt.Errorf("error writing to socket, previous write pending")
+var ErrSlowConsumer = fmt.Errorf("client is not keeping up with outbound messages")
 
-func (sc *StratumContext) write(data []byte) error {
-	if atomic.CompareAndSwapInt32(&sc.writeLock, 0, 1) {
-		defer atomic.StoreInt32(&sc.writeLock, 0)
-		deadline := time.Now().Add(5 * time.Second)
-		if err := sc.connection.SetWriteDeadline(deadline); err != nil {
-			return errors.Wrap(err, "failed setting write deadline for connection")
-		}
-		_, err := sc.connection.Write(data)
-		sc.checkDisconnect(err)
-		return err
+// QueueDepth is the number of messages waiting to be written to the client
+func (sc *StratumContext) QueueDepth() int {
+	queue := sc.writeQueue()
+	if queue == nil {
+		return 0
 	}
-	return errWriteBlocked
-}
-
-func (sc *StratumContext) writeWithBackoff(data []byte) error {
-	for i := 0; i < 3; i++ {
-		err := sc.write(data)
-		if err == nil {
-			return nil
-		} else if err == errWriteBlocked {
-			time.Sleep(5 * time.Millisecond)
-			continue
-		} else {
-			return err
+	return queue.depth()
+}
+
+// writeQueue lazily starts the client's writer, returning nil once the client
+// has disconnected without ever having been written to
+func (sc *StratumContext) writeQueue() *writeQueue {
+	sc.queueOnce.Do(func() {
+		sc.queue = newWriteQueue(sc.maxQueueDepth)
+		go sc.writeLoop(sc.queue)
+	})
+	return sc.queue
+}
+
+func (sc *StratumContext) enqueue(msg outboundMessage) error {
+	queue := sc.writeQueue()
+	if queue == nil || !sc.Connected() {
+		return ErrorDisconnected
+	}
+	if queue.push(msg) {
+		return nil
+	}
+	if !sc.Connected() {
+		return ErrorDisconnected
+	}
+	// the miner isn't reading from its socket, no sense in buffering forever
+	go sc.DisconnectWithReason(DisconnectSlowConsumer)
+	return ErrSlowConsumer
+}
+
+func (sc *StratumContext) writeLoop(queue *writeQueue) {
+	defer close(queue.done)
+	for {
+		<-queue.signal
+		data, closed := queue.take()
+		if len(data) > 0 {
+			if err := sc.write(data); err != nil {
+				queue.close()
+				go sc.DisconnectWithReason(DisconnectSocketError) // potentially blocking, so async it
+				return
+			}
 		}
+		if closed {
+			return
+		}
+	}
+}
+
+func (sc *StratumContext) write(data []byte) error {
+	deadline := time.Now().Add(writeTimeout)
+	if err := sc.connection.SetWriteDeadline(deadline); err != nil {
+		return errors.Wrap(err, "failed setting write deadline for connection")
 	}
-	// this should virtually never happen on a 'healthy' connection. Writes
-	// to the socket are actually just writing to the outgoing buffer for the
-	// connection in the OS, if this blocks it's because the receiver has not
-	// read from the buffer for such a length of time that the tx buffer is full
-	return fmt.Errorf("failed writing to socket after 3 attempts")
+	_, err := sc.connection.Write(data)
+	return err
 }
 
 func (sc *StratumContext) ReplySuccess(id any) error {
@@ -185,37 +277,87 @@ func (sc *StratumContext) ReplyLowDiffShare(id any) error {
 	})
 }
 
+func (sc *StratumContext) ReplyBadExtranonce(id any) error {
+	return sc.Reply(JsonRpcResponse{
+		Id:     id,
+		Result: nil,
+		Error:  []any{20, "Nonce outside of assigned extranonce", nil},
+	})
+}
+
+func (sc *StratumContext) ReplyShuttingDown(id any) error {
+	return sc.Reply(JsonRpcResponse{
+		Id:     id,
+		Result: nil,
+		Error:  []any{20, "Bridge shutting down, reconnect to submit", nil},
+	})
+}
+
+func (sc *StratumContext) ReplyBanned(id any, reason string) error {
+	return sc.Reply(JsonRpcResponse{
+		Id:     id,
+		Result: nil,
+		Error:  []any{24, fmt.Sprintf("Banned: %s", reason), nil},
+	})
+}
+
+// Disconnect closes the connection on behalf of the application
 func (sc *StratumContext) Disconnect() {
-	if !sc.disconnecting {
-		sc.Logger.Info("disconnecting")
-		sc.disconnecting = true
+	sc.DisconnectWithReason(DisconnectKicked)
+}
+
+func (sc *StratumContext) DisconnectWithReason(reason DisconnectReason) {
+	if atomic.CompareAndSwapInt32(&sc.disconnecting, 0, 1) {
+		sc.Logger.Info("disconnecting", zap.String("reason", string(reason)))
+		sc.reason = reason
+		sc.queueOnce.Do(func() {}) // no writer can be started past this point
+		if sc.queue != nil {
+			sc.queue.close()
+			if reason != DisconnectSocketError && reason != DisconnectSlowConsumer {
+				// give pending replies (e.g. an error explaining the disconnect)
+				// a chance to reach the miner
+				select {
+				case <-sc.queue.done:
+				case <-time.After(flushTimeout):
+				}
+			}
+		}
+		if sc.cancel != nil {
+			sc.cancel()
+		}
 		if sc.connection != nil {
 			sc.connection.Close()
 		}
-		sc.onDisconnect <- sc
+		if sc.onDisconnect != nil {
+			select {
+			case sc.onDisconnect <- sc:
+			case <-sc.parentContext.Done(): // listener is gone, nobody to notify
+			}
+		}
 	}
 }
 
-func (sc *StratumContext) checkDisconnect(err error) {
-	if err != nil { // actual error
-		go sc.Disconnect() // potentially blocking, so async it
+// Context interface impl, the context lives as long as the client connection
+
+func (sc *StratumContext) context() context.Context {
+	if sc.clientContext == nil { // bare contexts, e.g. in tests
+		return context.Background()
 	}
+	return sc.clientContext
 }
 
-// Context interface impl
-
-func (StratumContext) Deadline() (time.Time, bool) {
-	return time.Time{}, false
+func (sc *StratumContext) Deadline() (time.Time, bool) {
+	return sc.context().Deadline()
 }
 
-func (StratumContext) Done() <-chan struct{} {
-	return nil
+func (sc *StratumContext) Done() <-chan struct{} {
+	return sc.context().Done()
 }
 
-func (StratumContext) Err() error {
-	return nil
+func (sc *StratumContext) Err() error {
+	return sc.context().Err()
 }
 
-func (d StratumContext) Value(key any) any {
-	return d.parentContext.Value(key)
+func (sc *StratumContext) Value(key any) any {
+	return sc.context().Value(key)
 }
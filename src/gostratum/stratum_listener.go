@@ -1,154 +1,352 @@
-package gostratum
-
-import (
-	"context"
-	"fmt"
-	"net"
-	"strings"
-	"sync"
-
-	"github.com/pkg/errors"
-	"go.uber.org/zap"
-)
-
-type DisconnectChannel chan *StratumContext
-type StateGenerator func() any
-type EventHandler func(ctx *StratumContext, event JsonRpcEvent) error
-
-type StratumClientListener interface {
-	OnConnect(ctx *StratumContext)
-	OnDisconnect(ctx *StratumContext)
-}
-
-type StratumHandlerMap map[string]EventHandler
-
-type StratumStats struct {
-	Disconnects int64
-}
-
-type StratumListenerConfig struct {
-	Logger         *zap.Logger
-	HandlerMap     StratumHandlerMap
-	ClientListener StratumClientListener
-	StateGenerator StateGenerator
-	Port           string
-}
-
-type StratumListener struct {
-	StratumListenerConfig
-	shuttingDown      bool
-	disconnectChannel DisconnectChannel
-	stats             StratumStats
-	workerGroup       sync.WaitGroup
-}
-
-func NewListener(cfg StratumListenerConfig) *StratumListener {
-	listener := &StratumListener{
-		StratumListenerConfig: cfg,
-		workerGroup:           sync.WaitGroup{},
-		disconnectChannel:     make(DisconnectChannel),
-	}
-
-	listener.Logger = listener.Logger.With(
-		zap.String("component", "stratum"),
-		zap.String("address", listener.Port),
-	)
-
-	if listener.StateGenerator == nil {
-		listener.Logger.Warn("no state generator provided, using default")
-		listener.StateGenerator = func() any { return nil }
-	}
-
-	return listener
-}
-
-func (s *StratumListener) Listen(ctx context.Context) error {
-	s.shuttingDown = false
-
-	serverContext, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	lc := net.ListenConfig{}
-	server, err := lc.Listen(ctx, "tcp", s.Port)
-	if err != nil {
-		return errors.Wrapf(err, "failed listening to socket %s", s.Port)
-	}
-	defer server.Close()
-
-	go s.disconnectListener(serverContext)
-	go s.tcpListener(serverContext, server)
-
-	// block here until the context is killed
-	<-ctx.Done() // context cancelled, so kill the server
-	s.shuttingDown = true
-	server.Close()
-	s.workerGroup.Wait()
-	return context.Canceled
-}
-
-func (s *StratumListener) newClient(ctx context.Context, connection net.Conn) {
-	addr := connection.RemoteAddr().String()
-	parts := strings.Split(addr, ":")
-	if len(parts) > 0 {
-		addr = parts[0] // trim off the port
-	}
-	clientContext := &StratumContext{
-		parentContext: ctx,
-		RemoteAddr:    addr,
-		Logger:        s.Logger.With(zap.String("client", addr)),
-		connection:    connection,
-		State:         s.StateGenerator(),
-		onDisconnect:  s.disconnectChannel,
-	}
-
-	s.Logger.Info(fmt.Sprintf("new client connecting - %s", addr))
-
-	if s.ClientListener != nil { // TODO: should this be before we spawn the handler?
-		s.ClientListener.OnConnect(clientContext)
-	}
-
-	go spawnClientListener(clientContext, connection, s)
-
-}
-
-func (s *StratumListener) HandleEvent(ctx *StratumContext, event JsonRpcEvent) error {
-	if handler, exists := s.HandlerMap[string(event.Method)]; exists {
-		return handler(ctx, event)
-	}
-	//s.Logger.Warn(fmt.Sprintf("unhandled event '%+v'", event))
-	return nil
-}
-
-func (s *StratumListener) disconnectListener(ctx context.Context) {
-	s.workerGroup.Add(1)
-	defer s.workerGroup.Done()
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case client := <-s.disconnectChannel:
-			s.Logger.Info(fmt.Sprintf("client disconnecting - %s", client.RemoteAddr))
-			s.stats.Disconnects++
-			if s.ClientListener != nil {
-				s.ClientListener.OnDisconnect(client)
-			}
-		}
-	}
-}
-
-func (s *StratumListener) tcpListener(ctx context.Context, server net.Listener) {
-	s.workerGroup.Add(1)
-	defer s.workerGroup.Done()
-	for { // listen and spin forever
-		connection, err := server.Accept()
-		if err != nil {
-			if s.shuttingDown {
-				s.Logger.Error("stopping listening due to server shutdown")
-				return
-			}
-			s.Logger.Error("failed to accept incoming connection", zap.Error(err))
-			continue
-		}
-		s.newClient(ctx, connection)
-	}
-}
+package gostratum
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+type DisconnectChannel chan *StratumContext
+type StateGenerator func() any
+type EventHandler func(ctx *StratumContext, event JsonRpcEvent) error
+
+type StratumClientListener interface {
+	OnConnect(ctx *StratumContext)
+	OnDisconnect(ctx *StratumContext)
+}
+
+// StratumMalformedListener can optionally be implemented by the
+// ClientListener to be told about messages that couldn't be decoded
+type StratumMalformedListener interface {
+	OnMalformed(ctx *StratumContext, err error)
+}
+
+type StratumHandlerMap map[string]EventHandler
+
+type StratumStats struct {
+	Disconnects int64
+}
+
+type StratumListenerConfig struct {
+	Logger         *zap.Logger
+	HandlerMap     StratumHandlerMap
+	ClientListener StratumClientListener
+	StateGenerator StateGenerator
+	Port           string
+	Network        string     // tcp (dual stack, default), tcp4 or tcp6 (ipv6 only)
+	TLS            *TLSConfig // optional stratum+ssl listener
+	MaxLineLength  int
+	Limits         ConnectionLimits
+	// shared with other listeners so the limits hold across all of them,
+	// built from Limits if nil
+	Limiter *ConnectionLimiter
+	// outbound messages buffered per client before it's dropped as a slow
+	// consumer, DefaultWriteQueueDepth if unset
+	WriteQueueDepth int
+	// deadlines for a new client to subscribe and authorize, and the max time
+	// allowed between messages once connected. Zero disables each check
+	SubscribeTimeout time.Duration
+	AuthorizeTimeout time.Duration
+	IdleTimeout      time.Duration
+	// ProxyProtocol enables parsing of HAProxy PROXY v1/v2 headers from
+	// connections originating in ProxyTrustedCIDRs, which must not be empty
+	ProxyProtocol     bool
+	ProxyTrustedCIDRs []string
+}
+
+type StratumListener struct {
+	StratumListenerConfig
+	shuttingDown      bool
+	disconnectChannel DisconnectChannel
+	stats             StratumStats
+	workerGroup       sync.WaitGroup
+	proxyTrusted      []*net.IPNet
+	limiter           *ConnectionLimiter
+	serverLock        sync.Mutex
+	servers           []stratumSocket
+}
+
+// stratumSocket is a bound listener and the tls config for it, if any
+type stratumSocket struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+}
+
+func NewListener(cfg StratumListenerConfig) *StratumListener {
+	listener := &StratumListener{
+		StratumListenerConfig: cfg,
+		workerGroup:           sync.WaitGroup{},
+		disconnectChannel:     make(DisconnectChannel),
+		limiter:               cfg.Limiter,
+	}
+	if listener.limiter == nil {
+		listener.limiter = NewConnectionLimiter(cfg.Limits)
+	}
+
+	listener.Logger = listener.Logger.With(
+		zap.String("component", "stratum"),
+		zap.String("address", listener.Port),
+	)
+
+	if listener.Network == "" {
+		listener.Network = "tcp"
+	}
+
+	if listener.StateGenerator == nil {
+		listener.Logger.Warn("no state generator provided, using default")
+		listener.StateGenerator = func() any { return nil }
+	}
+
+	return listener
+}
+
+func (s *StratumListener) Listen(ctx context.Context) error {
+	s.shuttingDown = false
+
+	serverContext, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if s.ProxyProtocol {
+		trusted, err := parseTrustedCIDRs(s.ProxyTrustedCIDRs)
+		if err != nil {
+			return err
+		}
+		if len(trusted) == 0 {
+			// trusting everyone would let any miner pick its own ip
+			return fmt.Errorf("proxy protocol enabled without any trusted proxy sources")
+		}
+		s.proxyTrusted = trusted
+	}
+
+	lc := net.ListenConfig{}
+	var servers []stratumSocket
+	defer func() {
+		for _, server := range servers {
+			server.listener.Close()
+		}
+	}()
+	if s.Port != "" {
+		server, err := lc.Listen(ctx, s.Network, s.Port)
+		if err != nil {
+			return errors.Wrapf(err, "failed listening to socket %s", s.Port)
+		}
+		servers = append(servers, stratumSocket{listener: server})
+	}
+	if s.TLS != nil {
+		tlsConfig, reloader, err := s.TLS.build(s.Logger)
+		if err != nil {
+			return errors.Wrap(err, "failed configuring tls listener")
+		}
+		server, err := lc.Listen(ctx, s.Network, s.TLS.Port)
+		if err != nil {
+			return errors.Wrapf(err, "failed listening to tls socket %s", s.TLS.Port)
+		}
+		servers = append(servers, stratumSocket{listener: server, tlsConfig: tlsConfig})
+
+		interval := s.TLS.ReloadInterval
+		if interval <= 0 {
+			interval = defaultCertReloadInterval
+		}
+		go reloader.watch(serverContext, interval)
+		s.Logger.Info(fmt.Sprintf("tls enabled on %s", s.TLS.Port))
+	}
+	if len(servers) == 0 {
+		return fmt.Errorf("no stratum port configured")
+	}
+
+	s.serverLock.Lock()
+	s.servers = servers
+	s.serverLock.Unlock()
+
+	go s.disconnectListener(serverContext)
+	for _, server := range servers {
+		go s.tcpListener(serverContext, server.listener, server.tlsConfig)
+	}
+
+	// block here until the context is killed
+	<-ctx.Done() // context cancelled, so kill the server
+	s.StopAccepting()
+	s.workerGroup.Wait()
+	return context.Canceled
+}
+
+// StopAccepting closes the listening sockets while leaving connected clients
+// alone, so they can be migrated before the context passed to Listen is
+// cancelled
+func (s *StratumListener) StopAccepting() {
+	s.serverLock.Lock()
+	defer s.serverLock.Unlock()
+	s.shuttingDown = true
+	for _, server := range s.servers {
+		server.listener.Close()
+	}
+	s.servers = nil
+}
+
+func (s *StratumListener) newClient(ctx context.Context, connection net.Conn) {
+	addr := ClientAddr(connection.RemoteAddr())
+	now := time.Now()
+	childContext, cancel := context.WithCancel(ctx)
+	clientContext := &StratumContext{
+		connectTime:   now,
+		lastMessage:   now.UnixNano(),
+		parentContext: ctx,
+		clientContext: childContext,
+		cancel:        cancel,
+		RemoteAddr:    addr,
+		Logger:        s.Logger.With(zap.String("client", addr)),
+		connection:    connection,
+		State:         s.StateGenerator(),
+		onDisconnect:  s.disconnectChannel,
+		maxQueueDepth: s.WriteQueueDepth,
+	}
+	if tlsConn, ok := connection.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		clientContext.TLS = &state
+	}
+
+	s.Logger.Info(fmt.Sprintf("new client connecting - %s", addr))
+
+	if s.ClientListener != nil { // TODO: should this be before we spawn the handler?
+		s.ClientListener.OnConnect(clientContext)
+	}
+
+	// wake the reader as soon as the client is cancelled rather than waiting
+	// for the read deadline
+	context.AfterFunc(childContext, func() {
+		connection.SetReadDeadline(time.Now())
+	})
+	go spawnClientListener(clientContext, connection, s)
+
+}
+
+func (s *StratumListener) HandleEvent(ctx *StratumContext, event JsonRpcEvent) error {
+	ctx.touch()
+	if handler, exists := s.HandlerMap[string(event.Method)]; exists {
+		if err := handler(ctx, event); err != nil {
+			return err
+		}
+		switch event.Method {
+		case StratumMethodSubscribe:
+			atomic.StoreInt32(&ctx.subscribed, 1)
+		case StratumMethodAuthorize:
+			atomic.StoreInt32(&ctx.authorized, 1)
+		}
+		return nil
+	}
+	//s.Logger.Warn(fmt.Sprintf("unhandled event '%+v'", event))
+	return nil
+}
+
+// checkTimeouts returns the reason the client should be dropped, if any
+func (s *StratumListener) checkTimeouts(ctx *StratumContext, now time.Time) DisconnectReason {
+	sinceConnect := now.Sub(ctx.connectTime)
+	if s.SubscribeTimeout > 0 && !ctx.Subscribed() && !ctx.Authorized() && sinceConnect > s.SubscribeTimeout {
+		return DisconnectSubscribeTimeout
+	}
+	if s.AuthorizeTimeout > 0 && !ctx.Authorized() && sinceConnect > s.AuthorizeTimeout {
+		return DisconnectAuthorizeTimeout
+	}
+	if s.IdleTimeout > 0 && now.Sub(ctx.LastMessage()) > s.IdleTimeout {
+		return DisconnectIdleTimeout
+	}
+	return ""
+}
+
+func (s *StratumListener) disconnectListener(ctx context.Context) {
+	s.workerGroup.Add(1)
+	defer s.workerGroup.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case client := <-s.disconnectChannel:
+			s.Logger.Info(fmt.Sprintf("client disconnecting - %s", client.RemoteAddr))
+			s.stats.Disconnects++
+			s.limiter.release(client.RemoteAddr)
+			if s.ClientListener != nil {
+				s.ClientListener.OnDisconnect(client)
+			}
+		}
+	}
+}
+
+func (s *StratumListener) tcpListener(ctx context.Context, server net.Listener, tlsConfig *tls.Config) {
+	s.workerGroup.Add(1)
+	defer s.workerGroup.Done()
+	for { // listen and spin forever
+		connection, err := server.Accept()
+		if err != nil {
+			if s.shuttingDown {
+				s.Logger.Error("stopping listening due to server shutdown")
+				return
+			}
+			s.Logger.Error("failed to accept incoming connection", zap.Error(err))
+			continue
+		}
+		// with proxy protocol the real ip is only known after the header
+		if !s.ProxyProtocol && !s.admit(connection) {
+			continue
+		}
+		if s.ProxyProtocol || tlsConfig != nil {
+			// proxy headers and tls handshakes need reads from the client,
+			// do them off the accept loop so a slow client can't stall it
+			go s.prepareClient(ctx, connection, tlsConfig)
+			continue
+		}
+		s.newClient(ctx, connection)
+	}
+}
+
+// prepareClient strips the proxy header (if expected) and performs the tls
+// handshake (if configured) before handing the connection off to newClient
+func (s *StratumListener) prepareClient(ctx context.Context, connection net.Conn, tlsConfig *tls.Config) {
+	if s.ProxyProtocol && s.isProxyTrusted(connection.RemoteAddr()) {
+		proxied, err := readProxyHeader(connection)
+		if err != nil {
+			s.Logger.Warn("failed reading proxy protocol header", zap.String("client", connection.RemoteAddr().String()), zap.Error(err))
+			connection.Close()
+			return
+		}
+		connection = proxied
+	}
+	if s.ProxyProtocol && !s.admit(connection) {
+		return
+	}
+	if tlsConfig != nil {
+		tlsConn := tls.Server(connection, tlsConfig)
+		if err := handshake(ctx, tlsConn); err != nil {
+			s.Logger.Warn("tls handshake failed", zap.String("client", connection.RemoteAddr().String()), zap.Error(err))
+			tlsConn.Close()
+			s.limiter.release(ClientAddr(connection.RemoteAddr()))
+			return
+		}
+		connection = tlsConn
+	}
+	s.newClient(ctx, connection)
+}
+
+// admit checks the connection against the configured limits, closing it if
+// it's over any of them
+func (s *StratumListener) admit(connection net.Conn) bool {
+	addr := ClientAddr(connection.RemoteAddr())
+	reason, first := s.limiter.admit(addr)
+	if reason == "" {
+		return true
+	}
+	if first {
+		s.Logger.Warn(fmt.Sprintf("rejecting connections from %s: %s", addr, reason))
+	}
+	if listener, ok := s.ClientListener.(StratumRejectListener); ok {
+		listener.OnReject(addr, reason)
+	}
+	connection.Close()
+	return false
+}
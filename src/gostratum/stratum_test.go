@@ -1,13 +1,27 @@
 package gostratum
 
 import (
+	"bufio"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/mattn/go-colorable"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -44,7 +58,8 @@ func TestNewClient(t *testing.T) {
 	event, _ := json.Marshal(NewEvent("1", "mining.authorize", []any{
 		"", "test",
 	}))
-	mc.AsyncWriteTestDataToReadBuffer(string(event))
+	// messages are only delivered once their newline arrives
+	mc.AsyncWriteTestDataToReadBuffer(string(event) + "\n")
 
 	responseReceived := false
 	mc.ReadTestDataFromBuffer(func(b []byte) {
@@ -99,3 +114,535 @@ func TestWalletValidation(t *testing.T) {
 		}
 	}
 }
+
+func TestLineReaderReassembly(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		// a single message split across writes, followed by two messages in
+		// a single write
+		client.Write([]byte(`{"id":1,"method":"mining.su`))
+		client.Write([]byte("bscribe\"}\n"))
+		client.Write([]byte("{\"id\":2}\r\n{\"id\":3}\n"))
+	}()
+
+	reader := newLineReader(server, 0)
+	var lines []string
+	for len(lines) < 3 {
+		if err := reader.readLines(func(line string) error {
+			lines = append(lines, line)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []string{`{"id":1,"method":"mining.subscribe"}`, `{"id":2}`, `{"id":3}`}
+	if d := cmp.Diff(expected, lines); d != "" {
+		t.Fatalf("lines reassembled incorrectly: %s", d)
+	}
+}
+
+func TestLineReaderMaxLength(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go client.Write([]byte(strings.Repeat("a", 64)))
+
+	reader := newLineReader(server, 32)
+	var err error
+	for err == nil {
+		err = reader.readLines(func(line string) error {
+			t.Fatalf("unexpected line %s", line)
+			return nil
+		})
+	}
+	if !errors.Is(err, ErrFraming) {
+		t.Fatalf("expected framing error, got %s", err)
+	}
+}
+
+func TestProxyProtocolHeader(t *testing.T) {
+	v2 := append([]byte{}, proxyV2Signature...)
+	v2 = append(v2, 0x21, 0x11, 0, 12, 203, 0, 113, 7, 10, 0, 0, 1, 0x1f, 0x90, 0x15, 0xb3)
+
+	tests := []struct {
+		name     string
+		header   []byte
+		expected string
+	}{
+		{name: "v1 tcp4", header: []byte("PROXY TCP4 198.51.100.22 10.0.0.1 35646 5555\r\n"), expected: "198.51.100.22:35646"},
+		{name: "v1 tcp6", header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 35646 5555\r\n"), expected: "[2001:db8::1]:35646"},
+		{name: "v1 unknown", header: []byte("PROXY UNKNOWN\r\n"), expected: "pipe"},
+		{name: "v2 tcp4", header: v2, expected: "203.0.113.7:8080"},
+	}
+
+	for _, v := range tests {
+		client, server := net.Pipe()
+		go func() {
+			client.Write(append(v.header, []byte("{\"id\":1}\n")...))
+		}()
+		proxied, err := readProxyHeader(server)
+		if err != nil {
+			t.Fatalf("%s: %s", v.name, err)
+		}
+		if proxied.RemoteAddr().String() != v.expected {
+			t.Fatalf("%s: expected %s, got %s", v.name, v.expected, proxied.RemoteAddr())
+		}
+		// the stratum payload after the header must be untouched
+		reader := newLineReader(proxied, 0)
+		if err := reader.readLines(func(line string) error {
+			if line != `{"id":1}` {
+				t.Fatalf("%s: unexpected line after header %s", v.name, line)
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf("%s: %s", v.name, err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestProxyProtocolUntrusted(t *testing.T) {
+	cfg := DefaultConfig(testLogger())
+	cfg.ProxyProtocol = true
+	if err := NewListener(cfg).Listen(context.Background()); err == nil {
+		t.Fatalf("proxy protocol started without trusted sources")
+	}
+
+	// a header from a source outside the trusted list is never parsed, the
+	// client keeps its own address
+	recorder := &connectRecorder{connected: make(chan *StratumContext, 1)}
+	cfg.ClientListener = recorder
+	cfg.ProxyTrustedCIDRs = []string{"10.0.0.0/8"}
+	listener := NewListener(cfg)
+	listener.proxyTrusted, _ = parseTrustedCIDRs(cfg.ProxyTrustedCIDRs)
+	socket, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed listening: %s", err)
+	}
+	defer socket.Close()
+	client, err := net.Dial("tcp", socket.Addr().String())
+	if err != nil {
+		t.Fatalf("failed dialing: %s", err)
+	}
+	defer client.Close()
+	server, err := socket.Accept()
+	if err != nil {
+		t.Fatalf("failed accepting: %s", err)
+	}
+	go client.Write([]byte("PROXY TCP4 198.51.100.22 10.0.0.1 35646 5555\r\n"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go listener.prepareClient(ctx, server, nil)
+	select {
+	case connected := <-recorder.connected:
+		if connected.RemoteAddr != "127.0.0.1" {
+			t.Fatalf("untrusted proxy header replaced the address with %s", connected.RemoteAddr)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("client never connected")
+	}
+}
+
+type connectRecorder struct {
+	connected chan *StratumContext
+}
+
+func (cr *connectRecorder) OnConnect(ctx *StratumContext)    { cr.connected <- ctx }
+func (cr *connectRecorder) OnDisconnect(ctx *StratumContext) {}
+
+func TestClientAddrIPv6(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{in: "192.168.0.17:35646", expected: "192.168.0.17"},
+		{in: "[2001:db8::1]:5555", expected: "2001:db8::1"},
+		{in: "[2001:DB8:0:0::1]:5555", expected: "2001:db8::1"},
+		{in: "[::ffff:10.0.0.1]:5555", expected: "10.0.0.1"},
+		{in: "[fe80::1%eth0]:5555", expected: "fe80::1%eth0"},
+		{in: "2001:db8::2", expected: "2001:db8::2"},
+		{in: "mc_1", expected: "mc_1"},
+	}
+
+	for _, v := range tests {
+		if addr := ClientAddr(MockAddr{id: v.in}); addr != v.expected {
+			t.Fatalf("expected %s, got %s", v.expected, addr)
+		}
+	}
+
+	recorder := &connectRecorder{connected: make(chan *StratumContext, 1)}
+	cfg := DefaultConfig(testLogger())
+	cfg.ClientListener = recorder
+	listener := NewListener(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener.newClient(ctx, NewMockConnectionFromAddr("[2001:db8::7]:41000"))
+	client := <-recorder.connected
+	if client.RemoteAddr != "2001:db8::7" {
+		t.Fatalf("expected 2001:db8::7, got %s", client.RemoteAddr)
+	}
+}
+
+func TestConnectionLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := NewConnectionLimiter(ConnectionLimits{
+		MaxConnections:      3,
+		MaxConnectionsPerIP: 2,
+		ConnectRatePerIP:    2,
+		ConnectBurstPerIP:   3,
+	})
+	limiter.clock = func() time.Time { return now }
+
+	expectAdmit := func(addr string, expected RejectReason, expectedFirst bool) {
+		t.Helper()
+		reason, first := limiter.admit(addr)
+		if reason != expected || (reason != "" && first != expectedFirst) {
+			t.Fatalf("%s: expected %q (first %t), got %q (first %t)", addr, expected, expectedFirst, reason, first)
+		}
+	}
+
+	expectAdmit("10.0.0.1", "", false)
+	expectAdmit("10.0.0.1", "", false)
+	expectAdmit("10.0.0.1", RejectIPLimit, true)
+	expectAdmit("10.0.0.2", "", false)
+	expectAdmit("10.0.0.3", RejectGlobalLimit, true)
+
+	// burst of 3 is used up, rate limiting kicks in until tokens refill
+	limiter.release("10.0.0.1")
+	expectAdmit("10.0.0.1", RejectRateLimit, false)
+	now = now.Add(30 * time.Second)
+	expectAdmit("10.0.0.1", "", false)
+
+	// releasing clients that never went through the limiter is harmless
+	limiter.release("10.0.0.9")
+	if limiter.total != 3 {
+		t.Fatalf("expected 3 active connections, got %d", limiter.total)
+	}
+
+	// listeners sharing a limiter share its limits
+	cfg := DefaultConfig(testLogger())
+	cfg.Limiter = NewConnectionLimiter(ConnectionLimits{MaxConnections: 1})
+	first, second := NewListener(cfg), NewListener(cfg)
+	if reason, _ := first.limiter.admit("10.0.0.1"); reason != "" {
+		t.Fatalf("first connection rejected: %s", reason)
+	}
+	if reason, _ := second.limiter.admit("10.0.0.2"); reason != RejectGlobalLimit {
+		t.Fatalf("expected the global limit to hold across listeners, got %q", reason)
+	}
+}
+
+func TestClientTimeouts(t *testing.T) {
+	cfg := DefaultConfig(testLogger())
+	cfg.SubscribeTimeout = 5 * time.Second
+	cfg.AuthorizeTimeout = 10 * time.Second
+	cfg.IdleTimeout = time.Minute
+	listener := NewListener(cfg)
+
+	start := time.Now()
+	ctx := &StratumContext{connectTime: start, lastMessage: start.UnixNano()}
+	if reason := listener.checkTimeouts(ctx, start.Add(time.Second)); reason != "" {
+		t.Fatalf("unexpected timeout %s", reason)
+	}
+	if reason := listener.checkTimeouts(ctx, start.Add(6*time.Second)); reason != DisconnectSubscribeTimeout {
+		t.Fatalf("expected subscribe timeout, got %q", reason)
+	}
+	ctx.subscribed = 1
+	if reason := listener.checkTimeouts(ctx, start.Add(11*time.Second)); reason != DisconnectAuthorizeTimeout {
+		t.Fatalf("expected authorize timeout, got %q", reason)
+	}
+	ctx.authorized = 1
+	if reason := listener.checkTimeouts(ctx, start.Add(30*time.Second)); reason != "" {
+		t.Fatalf("unexpected timeout %s", reason)
+	}
+	if reason := listener.checkTimeouts(ctx, start.Add(2*time.Minute)); reason != DisconnectIdleTimeout {
+		t.Fatalf("expected idle timeout, got %q", reason)
+	}
+}
+
+func TestContextCancellation(t *testing.T) {
+	parent, cancelParent := context.WithCancel(context.Background())
+	ctx, _ := NewMockContext(parent, testLogger(), nil)
+	if ctx.Err() != nil {
+		t.Fatalf("context cancelled before disconnect")
+	}
+	ctx.Disconnect()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("context not cancelled on disconnect")
+	}
+	if ctx.DisconnectReason() != DisconnectKicked {
+		t.Fatalf("expected kicked, got %s", ctx.DisconnectReason())
+	}
+
+	other, _ := NewMockContext(parent, testLogger(), nil)
+	cancelParent()
+	select {
+	case <-other.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("context not cancelled with parent")
+	}
+}
+
+func TestWriteQueue(t *testing.T) {
+	q := newWriteQueue(3)
+	q.push(outboundMessage{data: []byte("job1\n"), job: true})
+	q.push(outboundMessage{data: []byte("reply\n")})
+	q.push(outboundMessage{data: []byte("job2\n"), job: true})
+	if d := q.depth(); d != 2 {
+		t.Fatalf("expected superseded job to be dropped, depth %d", d)
+	}
+	q.push(outboundMessage{data: []byte("diff\n")})
+	if q.push(outboundMessage{data: []byte("reply\n")}) {
+		t.Fatalf("push succeeded on a full queue")
+	}
+	data, closed := q.take()
+	if closed {
+		t.Fatalf("queue closed unexpectedly")
+	}
+	if d := cmp.Diff("reply\njob2\ndiff\n", string(data)); d != "" {
+		t.Fatalf("unexpected write order: %s", d)
+	}
+	q.close()
+	if q.push(outboundMessage{data: []byte("late\n")}) {
+		t.Fatalf("push succeeded on a closed queue")
+	}
+	if _, closed := q.take(); !closed {
+		t.Fatalf("expected closed queue")
+	}
+}
+
+func TestSlowConsumer(t *testing.T) {
+	ctx, _ := NewMockContext(context.Background(), testLogger(), nil)
+	server, client := net.Pipe()
+	defer client.Close()
+	ctx.connection = server
+	ctx.maxQueueDepth = 2
+	// nothing reads from the other end of the pipe, so the writer stalls on
+	// the first message and the rest back up behind it
+	var err error
+	for i := 0; i < 5 && err == nil; i++ {
+		err = ctx.Reply(JsonRpcResponse{Id: i, Result: true})
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !errors.Is(err, ErrSlowConsumer) {
+		t.Fatalf("expected slow consumer error, got %v", err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("slow consumer not disconnected")
+	}
+	if ctx.DisconnectReason() != DisconnectSlowConsumer {
+		t.Fatalf("expected slow_consumer, got %s", ctx.DisconnectReason())
+	}
+}
+
+func TestExtranonceNegotiation(t *testing.T) {
+	ctx, mc := NewMockContext(context.Background(), testLogger(), nil)
+	ctx.Extranonce = "0a1b"
+	readNext := func(out any) {
+		mc.ReadTestDataFromBuffer(func(b []byte) {
+			if err := json.Unmarshal(b, out); err != nil {
+				t.Fatalf("failed decoding %s: %s", b, err)
+			}
+		})
+	}
+
+	if err := HandleSubscribe(ctx, NewEvent("1", "mining.subscribe", []any{"TestMiner/1.0"})); err != nil {
+		t.Fatalf("subscribe failed: %s", err)
+	}
+	response := JsonRpcResponse{}
+	readNext(&response)
+	if d := cmp.Diff([]any{true, "EthereumStratum/1.0.0", "0a1b", 2.0}, response.Result); d != "" {
+		t.Fatalf("subscribe response missing extranonce: %s", d)
+	}
+	if ctx.RemoteApp != "TestMiner/1.0" {
+		t.Fatalf("user agent not recorded, got %s", ctx.RemoteApp)
+	}
+
+	if err := HandleExtranonceSubscribe(ctx, NewEvent("2", "mining.extranonce.subscribe", nil)); err != nil {
+		t.Fatalf("extranonce subscribe failed: %s", err)
+	}
+	readNext(&response)
+	if !ctx.ExtranonceSubscribed() {
+		t.Fatalf("extranonce subscription not recorded")
+	}
+
+	if err := SetExtranonce(ctx, "0c2d"); err != nil {
+		t.Fatalf("failed pushing extranonce: %s", err)
+	}
+	event := JsonRpcEvent{}
+	readNext(&event)
+	if event.Method != "mining.set_extranonce" {
+		t.Fatalf("expected mining.set_extranonce, got %s", event.Method)
+	}
+	if d := cmp.Diff([]any{"0c2d", 2.0}, event.Params); d != "" {
+		t.Fatalf("unexpected set_extranonce params: %s", d)
+	}
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 to the given
+// files, returning it parsed so clients can trust it
+func writeTestCert(t *testing.T, certFile, keyFile, name string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed generating key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed creating certificate: %s", err)
+	}
+	rawKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed encoding key: %s", err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("failed writing certificate: %s", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: rawKey}), 0600); err != nil {
+		t.Fatalf("failed writing key: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed parsing certificate: %s", err)
+	}
+	return cert
+}
+
+// startTLSListener runs a tls only listener on a free port until the test
+// ends, returning the address it's listening on
+func startTLSListener(t *testing.T, tlsConfig *TLSConfig) string {
+	t.Helper()
+	cfg := DefaultConfig(testLogger())
+	cfg.Port = ""
+	cfg.TLS = tlsConfig
+	listener := NewListener(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- listener.Listen(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		select {
+		case err := <-stopped:
+			t.Fatalf("listener stopped: %s", err)
+		default:
+		}
+		listener.serverLock.Lock()
+		servers := listener.servers
+		listener.serverLock.Unlock()
+		if len(servers) > 0 {
+			return servers[0].listener.Addr().String()
+		}
+	}
+	t.Fatalf("listener never started")
+	return ""
+}
+
+// dialTLS connects trusting only the given certificate, returning the
+// certificate the listener presented
+func dialTLS(t *testing.T, addr string, trusted *x509.Certificate) (*tls.Conn, *x509.Certificate) {
+	t.Helper()
+	roots := x509.NewCertPool()
+	roots.AddCert(trusted)
+	dialer := &net.Dialer{Timeout: time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("tls handshake failed: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, conn.ConnectionState().PeerCertificates[0]
+}
+
+func TestTLSListener(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	cert := writeTestCert(t, certFile, keyFile, "bridge")
+	addr := startTLSListener(t, &TLSConfig{Port: "127.0.0.1:0", CertFile: certFile, KeyFile: keyFile})
+
+	conn, _ := dialTLS(t, addr, cert)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(`{"id":1,"method":"mining.subscribe","params":["TestMiner/1.0"]}` + "\n")); err != nil {
+		t.Fatalf("failed sending subscribe: %s", err)
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("failed reading subscribe response: %s", err)
+	}
+	response := JsonRpcResponse{}
+	if err := json.Unmarshal(line, &response); err != nil {
+		t.Fatalf("failed decoding %s: %s", line, err)
+	}
+	if response.Id != float64(1) || response.Error != nil {
+		t.Fatalf("unexpected subscribe response %s", line)
+	}
+	if result, ok := response.Result.([]any); !ok || len(result) < 2 || result[1] != "EthereumStratum/1.0.0" {
+		t.Fatalf("unexpected subscribe result %s", line)
+	}
+
+	// clients that don't trust the certificate never get through
+	if _, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "127.0.0.1"}); err == nil {
+		t.Fatalf("handshake succeeded without trusting the certificate")
+	}
+}
+
+func TestTLSCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	first := writeTestCert(t, certFile, keyFile, "first")
+	addr := startTLSListener(t, &TLSConfig{
+		Port:           "127.0.0.1:0",
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		ReloadInterval: 10 * time.Millisecond,
+	})
+	if _, served := dialTLS(t, addr, first); served.Subject.CommonName != "first" {
+		t.Fatalf("expected the first certificate, got %s", served.Subject.CommonName)
+	}
+
+	// renewed on disk, new connections get the new certificate without a
+	// restart. The mod time is pushed ahead in case the filesystem's clock
+	// is coarse
+	second := writeTestCert(t, certFile, keyFile, "second")
+	later := time.Now().Add(time.Minute)
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, later, later); err != nil {
+			t.Fatalf("failed touching %s: %s", f, err)
+		}
+	}
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		roots := x509.NewCertPool()
+		roots.AddCert(second)
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"})
+		if err == nil {
+			served := conn.ConnectionState().PeerCertificates[0]
+			conn.Close()
+			if served.Subject.CommonName != "second" {
+				t.Fatalf("expected the second certificate, got %s", served.Subject.CommonName)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("certificate never reloaded: %s", err)
+		}
+	}
+}
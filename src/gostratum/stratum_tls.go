@@ -0,0 +1,155 @@
+package gostratum
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const defaultCertReloadInterval = 30 * time.Second
+const tlsHandshakeTimeout = 10 * time.Second
+
+// TLSConfig enables a stratum+ssl listener. It runs alongside the plain tcp
+// listener if both ports are configured
+type TLSConfig struct {
+	Port              string
+	CertFile          string
+	KeyFile           string
+	ClientCAFile      string // if set, client certs are verified against this CA bundle
+	RequireClientCert bool   // reject clients that don't present a valid cert
+	ReloadInterval    time.Duration
+}
+
+// certReloader serves the configured key pair and swaps it out whenever the
+// files on disk change, so certs can be renewed without restarting miners
+type certReloader struct {
+	certFile string
+	keyFile  string
+	logger   *zap.Logger
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func newCertReloader(certFile, keyFile string, logger *zap.Logger) (*certReloader, error) {
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger,
+	}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (cr *certReloader) load() error {
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		return errors.Wrap(err, "failed reading tls certificate")
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "failed loading tls key pair")
+	}
+	cr.lock.Lock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	cr.lock.Unlock()
+	return nil
+}
+
+func (cr *certReloader) reloadIfChanged() {
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		cr.logger.Warn("unable to check tls certificate for changes", zap.Error(err))
+		return
+	}
+	cr.lock.RLock()
+	changed := modTime.After(cr.modTime)
+	cr.lock.RUnlock()
+	if !changed {
+		return
+	}
+	if err := cr.load(); err != nil {
+		// keep serving the previous cert, the files may be mid-write
+		cr.logger.Error("failed reloading tls certificate, keeping previous", zap.Error(err))
+		return
+	}
+	cr.logger.Info("reloaded tls certificate")
+}
+
+func (cr *certReloader) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cr.reloadIfChanged()
+		}
+	}
+}
+
+func (cr *certReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+	return cr.cert, nil
+}
+
+func (c *TLSConfig) build(logger *zap.Logger) (*tls.Config, *certReloader, error) {
+	reloader, err := newCertReloader(c.CertFile, c.KeyFile, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if c.ClientCAFile != "" {
+		raw, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed reading tls client ca file")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(raw) {
+			return nil, nil, fmt.Errorf("no certificates found in tls client ca file %s", c.ClientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if c.RequireClientCert {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if c.RequireClientCert {
+		return nil, nil, fmt.Errorf("tls client certs required but no client ca file provided")
+	}
+	return cfg, reloader, nil
+}
+
+func handshake(ctx context.Context, connection *tls.Conn) error {
+	handshakeCtx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancel()
+	return connection.HandshakeContext(handshakeCtx)
+}
@@ -0,0 +1,112 @@
+package gostratum
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultWriteQueueDepth is the number of outbound messages that can be
+// pending for a client before it's considered a slow consumer
+const DefaultWriteQueueDepth = 64
+
+const writeTimeout = 5 * time.Second
+const flushTimeout = time.Second
+
+type outboundMessage struct {
+	data []byte
+	job  bool // mining.notify, superseded by any newer job queued behind it
+}
+
+// writeQueue buffers outbound messages for a single client so callers never
+// block on (or race for) the socket. Messages are written in order by the
+// client's writer goroutine, except that a job still waiting to be sent is
+// dropped when a newer job is queued, since the miner would only discard it
+type writeQueue struct {
+	lock     sync.Mutex
+	pending  []outboundMessage
+	maxDepth int
+	closed   bool
+	signal   chan struct{}
+	done     chan struct{}
+}
+
+func newWriteQueue(maxDepth int) *writeQueue {
+	if maxDepth <= 0 {
+		maxDepth = DefaultWriteQueueDepth
+	}
+	return &writeQueue{
+		maxDepth: maxDepth,
+		signal:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// push queues the message, returning false if the queue is closed or full
+func (q *writeQueue) push(msg outboundMessage) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return false
+	}
+	if msg.job {
+		kept := q.pending[:0]
+		for _, m := range q.pending {
+			if !m.job {
+				kept = append(kept, m)
+			}
+		}
+		// clear the tail so dropped messages can be collected
+		for i := len(kept); i < len(q.pending); i++ {
+			q.pending[i] = outboundMessage{}
+		}
+		q.pending = kept
+	}
+	if len(q.pending) >= q.maxDepth {
+		return false
+	}
+	q.pending = append(q.pending, msg)
+	select {
+	case q.signal <- struct{}{}:
+	default: // writer already has a wakeup pending
+	}
+	return true
+}
+
+// take removes everything pending, concatenated into a single write
+func (q *writeQueue) take() ([]byte, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.pending) == 0 {
+		return nil, q.closed
+	}
+	var size int
+	for _, m := range q.pending {
+		size += len(m.data)
+	}
+	buffer := make([]byte, 0, size)
+	for _, m := range q.pending {
+		buffer = append(buffer, m.data...)
+	}
+	q.pending = q.pending[:0]
+	return buffer, q.closed
+}
+
+// close stops accepting messages, the writer exits once the rest is flushed
+func (q *writeQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (q *writeQueue) depth() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.pending)
+}
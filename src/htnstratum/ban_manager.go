@@ -0,0 +1,290 @@
+package htnstratum
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Hoosat-Oy/htn-stratum-bridge/src/gostratum"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const defaultBanDuration = time.Hour
+
+// offenses older than this are forgotten, so a rig that misbehaved once
+// doesn't carry the count around forever
+const offenseWindow = 10 * time.Minute
+const banSweepInterval = time.Minute
+
+type BanConfig struct {
+	Duration          time.Duration // 0 uses the default, negative bans forever
+	InvalidShareRatio float64       // ban once invalid/total shares exceeds this, 0 disables
+	MinShares         int64         // shares required before the ratio is evaluated
+	MaxMalformed      int64         // ban after this many malformed messages, 0 disables
+	File              string        // optional, bans are persisted here across restarts
+	Wallets           []string      // banned for as long as they're listed
+}
+
+type banKind string
+
+const (
+	banByIP     banKind = "ip"
+	banByWallet banKind = "wallet"
+)
+
+type BanEntry struct {
+	Kind    banKind   `json:"kind"`
+	Key     string    `json:"key"`
+	Reason  string    `json:"reason"`
+	Expires time.Time `json:"expires"` // zero for permanent bans
+
+	configured bool // listed in the config, which is where it lives rather than the file
+}
+
+func (b *BanEntry) expired(now time.Time) bool {
+	return !b.Expires.IsZero() && now.After(b.Expires)
+}
+
+func (b *BanEntry) matches(ctx *gostratum.StratumContext) bool {
+	switch b.Kind {
+	case banByIP:
+		return ctx.RemoteAddr == b.Key
+	case banByWallet:
+		return ctx.WalletAddr != "" && ctx.WalletAddr == b.Key
+	}
+	return false
+}
+
+type offenses struct {
+	windowStart time.Time
+	shares      int64
+	invalid     int64
+	malformed   int64
+}
+
+// banManager tracks misbehaving miners by ip and wallet. A nil manager bans
+// nothing, which keeps it optional for tests and callers
+type banManager struct {
+	cfg      BanConfig
+	logger   *zap.SugaredLogger
+	lock     sync.Mutex
+	bans     map[string]*BanEntry
+	offenses map[string]*offenses
+	onBan    func(*BanEntry)
+	clock    func() time.Time
+
+	lastSweep time.Time
+}
+
+func newBanManager(cfg BanConfig, logger *zap.SugaredLogger) *banManager {
+	if cfg.Duration == 0 {
+		cfg.Duration = defaultBanDuration
+	}
+	bm := &banManager{
+		cfg:      cfg,
+		logger:   logger.With(zap.String("component", "bans")),
+		bans:     map[string]*BanEntry{},
+		offenses: map[string]*offenses{},
+		clock:    time.Now,
+	}
+	if cfg.File != "" {
+		if err := bm.load(); err != nil {
+			bm.logger.Warn("failed loading persisted bans, starting empty", zap.Error(err))
+		}
+	}
+	for _, wallet := range cfg.Wallets {
+		if wallet == "" {
+			continue
+		}
+		bm.bans[banKey(banByWallet, wallet)] = &BanEntry{
+			Kind:       banByWallet,
+			Key:        wallet,
+			Reason:     "banned by the bridge operator",
+			configured: true,
+		}
+	}
+	return bm
+}
+
+func banKey(kind banKind, key string) string {
+	return string(kind) + ":" + key
+}
+
+// Banned returns the active ban for the ip or wallet, if any
+func (bm *banManager) Banned(addr string, wallet string) (*BanEntry, bool) {
+	if bm == nil {
+		return nil, false
+	}
+	bm.lock.Lock()
+	defer bm.lock.Unlock()
+	now := bm.clock()
+	for _, key := range []string{banKey(banByIP, addr), banKey(banByWallet, wallet)} {
+		ban, exists := bm.bans[key]
+		if !exists {
+			continue
+		}
+		if ban.expired(now) {
+			delete(bm.bans, key)
+			continue
+		}
+		return ban, true
+	}
+	return nil, false
+}
+
+func (bm *banManager) BanIP(addr string, reason string) {
+	bm.ban(banByIP, addr, reason)
+}
+
+func (bm *banManager) ban(kind banKind, key string, reason string) {
+	if bm == nil || key == "" {
+		return
+	}
+	entry := &BanEntry{Kind: kind, Key: key, Reason: reason}
+	if bm.cfg.Duration > 0 {
+		entry.Expires = bm.clock().Add(bm.cfg.Duration)
+	}
+	bm.lock.Lock()
+	bm.bans[banKey(kind, key)] = entry
+	if kind == banByIP {
+		delete(bm.offenses, key)
+	}
+	bm.persist()
+	bm.lock.Unlock()
+
+	bm.logger.Warn(fmt.Sprintf("banned %s %s: %s", kind, key, reason))
+	RecordBan(kind)
+	if bm.onBan != nil {
+		bm.onBan(entry)
+	}
+}
+
+// sweep forgets offense counters past their window so ips that connected
+// once don't stay around, the lock must be held
+func (bm *banManager) sweep(now time.Time) {
+	bm.lastSweep = now
+	for addr, o := range bm.offenses {
+		if now.Sub(o.windowStart) > offenseWindow {
+			delete(bm.offenses, addr)
+		}
+	}
+}
+
+func (bm *banManager) getOffenses(addr string) *offenses {
+	now := bm.clock()
+	if now.Sub(bm.lastSweep) > banSweepInterval {
+		bm.sweep(now)
+	}
+	o, exists := bm.offenses[addr]
+	if !exists || now.Sub(o.windowStart) > offenseWindow {
+		o = &offenses{windowStart: now}
+		bm.offenses[addr] = o
+	}
+	return o
+}
+
+// RecordShare feeds the invalid share ratio check. Stale shares shouldn't be
+// recorded, those are down to network latency rather than the miner
+func (bm *banManager) RecordShare(ctx *gostratum.StratumContext, valid bool) {
+	if bm == nil || bm.cfg.InvalidShareRatio <= 0 {
+		return
+	}
+	bm.lock.Lock()
+	o := bm.getOffenses(ctx.RemoteAddr)
+	o.shares++
+	if !valid {
+		o.invalid++
+	}
+	minShares := bm.cfg.MinShares
+	if minShares <= 0 {
+		minShares = 1
+	}
+	ratio := float64(o.invalid) / float64(o.shares)
+	exceeded := o.shares >= minShares && ratio > bm.cfg.InvalidShareRatio
+	bm.lock.Unlock()
+
+	if exceeded {
+		bm.BanIP(ctx.RemoteAddr, fmt.Sprintf("invalid share ratio %.2f", ratio))
+	}
+}
+
+func (bm *banManager) RecordMalformed(ctx *gostratum.StratumContext) {
+	if bm == nil || bm.cfg.MaxMalformed <= 0 {
+		return
+	}
+	bm.lock.Lock()
+	o := bm.getOffenses(ctx.RemoteAddr)
+	o.malformed++
+	exceeded := o.malformed >= bm.cfg.MaxMalformed
+	bm.lock.Unlock()
+
+	if exceeded {
+		bm.BanIP(ctx.RemoteAddr, "too many malformed messages")
+	}
+}
+
+// persist writes the active bans out, must be called with the lock held
+func (bm *banManager) persist() {
+	if bm.cfg.File == "" {
+		return
+	}
+	now := bm.clock()
+	active := make([]*BanEntry, 0, len(bm.bans))
+	for key, ban := range bm.bans {
+		if ban.expired(now) {
+			delete(bm.bans, key)
+			continue
+		}
+		if ban.configured {
+			continue
+		}
+		active = append(active, ban)
+	}
+	raw, err := json.MarshalIndent(active, "", "  ")
+	if err != nil {
+		bm.logger.Error("failed encoding bans", zap.Error(err))
+		return
+	}
+	// write then rename so a crash can't leave a truncated file behind
+	tmp := bm.cfg.File + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0644); err != nil {
+		bm.logger.Error("failed writing bans file", zap.Error(err))
+		return
+	}
+	if err := os.Rename(tmp, bm.cfg.File); err != nil {
+		bm.logger.Error("failed writing bans file", zap.Error(err))
+	}
+}
+
+func (bm *banManager) load() error {
+	raw, err := os.ReadFile(bm.cfg.File)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed reading bans file")
+	}
+	var entries []*BanEntry
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return errors.Wrap(err, "failed parsing bans file")
+	}
+	now := bm.clock()
+	for _, ban := range entries {
+		if ban.expired(now) || ban.Key == "" {
+			continue
+		}
+		bm.bans[banKey(ban.Kind, ban.Key)] = ban
+	}
+	bm.logger.Info(fmt.Sprintf("loaded %d active bans", len(bm.bans)))
+	return nil
+}
+
+func banMessage(ban *BanEntry) string {
+	if ban.Expires.IsZero() {
+		return ban.Reason
+	}
+	return fmt.Sprintf("%s, expires %s", ban.Reason, ban.Expires.UTC().Format(time.RFC3339))
+}
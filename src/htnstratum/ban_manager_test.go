@@ -0,0 +1,78 @@
+package htnstratum
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Hoosat-Oy/htn-stratum-bridge/src/gostratum"
+	"go.uber.org/zap"
+)
+
+func TestBanManager(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bans.json")
+	now := time.Now()
+	bm := newBanManager(BanConfig{
+		Duration:          time.Minute,
+		InvalidShareRatio: 0.5,
+		MinShares:         4,
+		MaxMalformed:      3,
+		File:              file,
+		Wallets:           []string{"hoosat:def"},
+	}, zap.NewNop().Sugar())
+	bm.clock = func() time.Time { return now }
+
+	var kicked []*BanEntry
+	bm.onBan = func(ban *BanEntry) { kicked = append(kicked, ban) }
+
+	rig := &gostratum.StratumContext{RemoteAddr: "10.0.0.1", WalletAddr: "hoosat:abc"}
+	bm.RecordShare(rig, false)
+	bm.RecordShare(rig, false)
+	bm.RecordShare(rig, true)
+	if _, banned := bm.Banned(rig.RemoteAddr, rig.WalletAddr); banned {
+		t.Fatalf("banned before min shares were reached")
+	}
+	bm.RecordShare(rig, false)
+	if _, banned := bm.Banned(rig.RemoteAddr, rig.WalletAddr); !banned {
+		t.Fatalf("expected ban once invalid ratio exceeded")
+	}
+	if len(kicked) != 1 || kicked[0].Kind != banByIP {
+		t.Fatalf("expected a single ip ban to be reported, got %+v", kicked)
+	}
+
+	scanner := &gostratum.StratumContext{RemoteAddr: "10.0.0.2"}
+	for i := 0; i < 3; i++ {
+		bm.RecordMalformed(scanner)
+	}
+	if _, banned := bm.Banned(scanner.RemoteAddr, ""); !banned {
+		t.Fatalf("expected ban after malformed messages")
+	}
+
+	if _, banned := bm.Banned("10.0.0.3", "hoosat:def"); !banned {
+		t.Fatalf("expected wallet ban to apply from any ip")
+	}
+
+	// bans survive a restart, wallet bans only as long as they're configured
+	reloaded := newBanManager(BanConfig{Duration: time.Minute, File: file}, zap.NewNop().Sugar())
+	reloaded.clock = func() time.Time { return now }
+	if _, banned := reloaded.Banned(rig.RemoteAddr, ""); !banned {
+		t.Fatalf("expected persisted ban to be loaded")
+	}
+	if _, banned := reloaded.Banned("10.0.0.3", "hoosat:def"); banned {
+		t.Fatalf("wallet ban outlived its removal from the config")
+	}
+
+	// offenses of ips that went quiet are forgotten
+	bm.RecordShare(&gostratum.StratumContext{RemoteAddr: "10.0.0.4"}, false)
+	now = now.Add(offenseWindow + banSweepInterval + time.Second)
+	bm.RecordShare(&gostratum.StratumContext{RemoteAddr: "10.0.0.5"}, true)
+	if _, exists := bm.offenses["10.0.0.4"]; exists || len(bm.offenses) != 1 {
+		t.Fatalf("expected old offenses swept, have %d", len(bm.offenses))
+	}
+
+	// and expire
+	now = now.Add(2 * time.Minute)
+	if _, banned := bm.Banned(rig.RemoteAddr, ""); banned {
+		t.Fatalf("expected ban to expire")
+	}
+}
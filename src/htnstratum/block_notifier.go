@@ -0,0 +1,86 @@
+package htnstratum
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultNotificationTimeout = time.Second
+
+// blockNotifier sits between the node's new block template notifications and
+// the job fan-out. Notifications never block the rpc client, a burst arriving
+// while the previous one is being handled collapses into a single event
+// stamped with the time of its first notification. Polling takes over only
+// once notifications have been silent for the timeout
+type blockNotifier struct {
+	lock             sync.Mutex
+	ready            chan struct{}
+	pending          time.Time // first notification not yet handled, zero if none
+	lastNotification time.Time
+	timeout          time.Duration
+	polling          bool
+	clock            func() time.Time
+}
+
+func newBlockNotifier(timeout time.Duration) *blockNotifier {
+	if timeout <= 0 {
+		timeout = defaultNotificationTimeout
+	}
+	bn := &blockNotifier{
+		ready:   make(chan struct{}, 1),
+		timeout: timeout,
+		clock:   time.Now,
+	}
+	bn.lastNotification = bn.clock()
+	return bn
+}
+
+// Notify is called from the rpc client for each notification
+func (bn *blockNotifier) Notify() {
+	bn.lock.Lock()
+	defer bn.lock.Unlock()
+	now := bn.clock()
+	bn.lastNotification = now
+	if !bn.pending.IsZero() {
+		RecordTemplateNotificationCoalesced()
+		return
+	}
+	bn.pending = now
+	select {
+	case bn.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Take returns when the pending notifications started
+func (bn *blockNotifier) Take() time.Time {
+	bn.lock.Lock()
+	defer bn.lock.Unlock()
+	notified := bn.pending
+	bn.pending = time.Time{}
+	if notified.IsZero() {
+		notified = bn.clock()
+	}
+	return notified
+}
+
+// Silent says whether it's been longer than the timeout since the last
+// notification, so the template should be polled
+func (bn *blockNotifier) Silent() bool {
+	bn.lock.Lock()
+	defer bn.lock.Unlock()
+	return bn.clock().Sub(bn.lastNotification) > bn.timeout
+}
+
+// SetPolling switches between notification and polling mode, returning
+// whether the mode changed
+func (bn *blockNotifier) SetPolling(polling bool) bool {
+	bn.lock.Lock()
+	defer bn.lock.Unlock()
+	if bn.polling == polling {
+		return false
+	}
+	bn.polling = polling
+	RecordTemplateMode(polling)
+	return true
+}
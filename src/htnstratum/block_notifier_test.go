@@ -0,0 +1,68 @@
+package htnstratum
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBlockNotifier(t *testing.T) {
+	now := time.Now()
+	bn := newBlockNotifier(time.Second)
+	bn.clock = func() time.Time { return now }
+	bn.lastNotification = now
+
+	// a burst collapses into one event from its first notification
+	first := now
+	bn.Notify()
+	now = now.Add(10 * time.Millisecond)
+	bn.Notify()
+	bn.Notify()
+	select {
+	case <-bn.ready:
+	default:
+		t.Fatalf("notification not signalled")
+	}
+	select {
+	case <-bn.ready:
+		t.Fatalf("burst signalled more than once")
+	default:
+	}
+	if notified := bn.Take(); !notified.Equal(first) {
+		t.Fatalf("expected event from the first notification %s, got %s", first, notified)
+	}
+
+	// the next notification after handling is a new event
+	now = now.Add(200 * time.Millisecond)
+	bn.Notify()
+	select {
+	case <-bn.ready:
+	default:
+		t.Fatalf("notification after handling not signalled")
+	}
+	if notified := bn.Take(); !notified.Equal(now) {
+		t.Fatalf("expected event at %s, got %s", now, notified)
+	}
+
+	// polling only takes over once notifications go quiet
+	if bn.Silent() {
+		t.Fatalf("silent right after a notification")
+	}
+	now = now.Add(900 * time.Millisecond)
+	if bn.Silent() {
+		t.Fatalf("silent before the timeout")
+	}
+	now = now.Add(200 * time.Millisecond)
+	if !bn.Silent() {
+		t.Fatalf("not silent after the timeout")
+	}
+	if !bn.SetPolling(true) || bn.SetPolling(true) {
+		t.Fatalf("expected a single switch to polling")
+	}
+	bn.Notify()
+	if bn.Silent() {
+		t.Fatalf("still silent after a notification")
+	}
+	if !bn.SetPolling(false) {
+		t.Fatalf("expected switch back to notifications")
+	}
+}
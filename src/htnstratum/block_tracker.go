@@ -0,0 +1,362 @@
+package htnstratum
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Hoosat-Oy/HTND/app/appmessage"
+	"github.com/Hoosat-Oy/HTND/domain/consensus/model/externalapi"
+	"github.com/Hoosat-Oy/HTND/domain/consensus/utils/consensushashing"
+	"github.com/Hoosat-Oy/htn-stratum-bridge/src/gostratum"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// blue score depth at which a block's fate is no longer followed
+	defaultBlockConfirmations = 100
+	// how long a submitted block may stay unknown to the node before it's
+	// considered never accepted
+	defaultBlockAcceptTimeout = 30 * time.Second
+	blockTrackerInterval      = 2 * time.Second
+	// finished blocks kept for the http endpoint
+	trackedBlockHistory = 1000
+	// descendants looked up per block when searching for the chain block
+	// that merged it
+	blockLookupLimit = 32
+)
+
+type blockFate string
+
+const (
+	fatePending  blockFate = "pending"
+	fateBlue     blockFate = "blue"
+	fateRed      blockFate = "red"
+	fateOrphaned blockFate = "orphaned" // never accepted or never merged
+)
+
+// TrackedBlock is a block the bridge submitted and what became of it
+type TrackedBlock struct {
+	Hash          string    `json:"hash"`
+	Worker        string    `json:"worker"`
+	Wallet        string    `json:"wallet"`
+	Port          string    `json:"port"`
+	JobId         int64     `json:"jobId"`
+	BlueScore     uint64    `json:"blueScore"`
+	Submitted     time.Time `json:"submitted"`
+	Fate          blockFate `json:"fate"`
+	Chain         bool      `json:"chain"` // on the selected parent chain, always blue
+	Confirmations uint64    `json:"confirmations"`
+	Final         bool      `json:"final"`
+	Reason        string    `json:"reason,omitempty"`
+
+	// metric labels of the worker that found it, copied so the tracker
+	// doesn't keep the client alive, dropped once the fate is recorded
+	labels prometheus.Labels
+	seen   bool // the node has known the block at some point
+}
+
+// blockLookup fetches a block's verbose data from the node
+type blockLookup func(hash string) (*appmessage.RPCBlock, error)
+
+// blockTracker follows the blocks the bridge submitted until their fate is
+// settled: blue (on or merged blue into the selected chain), red, or
+// orphaned. Each pending block is looked up periodically, its confirmations
+// are measured against the chain tip. A nil tracker tracks nothing
+type blockTracker struct {
+	lock          sync.Mutex
+	pending       []*TrackedBlock
+	finished      []*TrackedBlock // newest last, at most trackedBlockHistory
+	totals        map[string]map[blockFate]int64
+	lookup        blockLookup
+	tip           *chainTip
+	confirmations uint64
+	acceptTimeout time.Duration
+	clock         func() time.Time
+}
+
+func newBlockTracker(lookup blockLookup, tip *chainTip) *blockTracker {
+	return &blockTracker{
+		totals:        map[string]map[blockFate]int64{},
+		lookup:        lookup,
+		tip:           tip,
+		confirmations: defaultBlockConfirmations,
+		acceptTimeout: defaultBlockAcceptTimeout,
+		clock:         time.Now,
+	}
+}
+
+// Track starts following a block right after it was submitted. Only a block
+// the node rejected as invalid is orphaned straight away, a duplicate is
+// already in the dag and after a transport error the node may well have
+// accepted it, so both are left for Check to find out
+func (bt *blockTracker) Track(ctx *gostratum.StratumContext, block *externalapi.DomainBlock, jobId int64,
+	reason appmessage.RejectReason, submitErr error) {
+	if bt == nil {
+		return
+	}
+	hash := consensushashing.BlockHash(block).String()
+	tracked := &TrackedBlock{
+		Hash:      hash,
+		Worker:    ctx.WorkerName,
+		Wallet:    ctx.WalletAddr,
+		JobId:     jobId,
+		BlueScore: block.Header.BlueScore(),
+		Submitted: bt.clock(),
+		Fate:      fatePending,
+		labels:    commonLabels(ctx),
+	}
+	if state, ok := ctx.State.(*MiningState); ok {
+		tracked.Port = state.Port().name
+	}
+	if submitErr != nil {
+		tracked.Reason = submitErr.Error()
+	}
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	if existing := bt.find(hash); existing != nil {
+		// resent, or already in the dag, either way it's followed already
+		if submitErr == nil && !existing.Final {
+			existing.Reason = ""
+		}
+		return
+	}
+	bt.count(tracked.Worker, fatePending, 1)
+	if isBlockRejection(reason, submitErr) {
+		bt.finish(tracked, fateOrphaned)
+		return
+	}
+	bt.pending = append(bt.pending, tracked)
+}
+
+// isBlockRejection tells whether the node judged the block invalid, as
+// opposed to already having it or never getting to judge it
+func isBlockRejection(reason appmessage.RejectReason, err error) bool {
+	return err != nil && reason == appmessage.RejectReasonBlockInvalid && !isDuplicateBlock(err)
+}
+
+// isDuplicateBlock tells whether the node refused a block because it
+// already has it
+func isDuplicateBlock(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "ErrDuplicateBlock")
+}
+
+// find returns the block if it's pending or recently settled, the lock must
+// be held
+func (bt *blockTracker) find(hash string) *TrackedBlock {
+	for _, blocks := range [][]*TrackedBlock{bt.pending, bt.finished} {
+		for _, tracked := range blocks {
+			if tracked.Hash == hash {
+				return tracked
+			}
+		}
+	}
+	return nil
+}
+
+// Run checks the pending blocks until the context is done
+func (bt *blockTracker) Run(ctx context.Context) {
+	ticker := time.NewTicker(blockTrackerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			bt.Check()
+		}
+	}
+}
+
+// blockStatus is what a lookup found out about a pending block
+type blockStatus struct {
+	found     bool
+	blueScore uint64
+	fate      blockFate
+	chain     bool
+}
+
+// Check looks up every pending block and settles those deep enough
+func (bt *blockTracker) Check() {
+	bt.lock.Lock()
+	pending := append([]*TrackedBlock(nil), bt.pending...)
+	bt.lock.Unlock()
+
+	// lookups go to the node, so they're done without holding the lock
+	statuses := make([]blockStatus, len(pending))
+	for i, tracked := range pending {
+		statuses[i] = bt.classify(tracked.Hash)
+	}
+
+	tip, tipKnown := bt.tip.BlueScore()
+	now := bt.clock()
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	for i, tracked := range pending {
+		status := statuses[i]
+		if !status.found {
+			if !tracked.seen && now.Sub(tracked.Submitted) > bt.acceptTimeout {
+				tracked.Reason = "not accepted by the node"
+				bt.finish(tracked, fateOrphaned)
+			}
+			continue
+		}
+		tracked.seen = true
+		tracked.BlueScore = status.blueScore
+		tracked.Fate = status.fate
+		tracked.Chain = status.chain
+		if tipKnown && tip > tracked.BlueScore {
+			tracked.Confirmations = tip - tracked.BlueScore
+		}
+		if tracked.Confirmations < bt.confirmations {
+			continue
+		}
+		if status.fate == fatePending {
+			tracked.Reason = "never merged into the chain"
+			bt.finish(tracked, fateOrphaned)
+			continue
+		}
+		bt.finish(tracked, status.fate)
+	}
+	kept := bt.pending[:0]
+	for _, tracked := range bt.pending {
+		if !tracked.Final {
+			kept = append(kept, tracked)
+		}
+	}
+	for i := len(kept); i < len(bt.pending); i++ {
+		bt.pending[i] = nil
+	}
+	bt.pending = kept
+	RecordTrackedBlocksPending(len(bt.pending))
+}
+
+// classify finds the block's color from the first chain block among its
+// descendants that has it in its merge set
+func (bt *blockTracker) classify(hash string) blockStatus {
+	block, err := bt.lookup(hash)
+	if err != nil || block == nil || block.VerboseData == nil {
+		return blockStatus{}
+	}
+	status := blockStatus{found: true, blueScore: block.VerboseData.BlueScore, fate: fatePending}
+	if block.VerboseData.IsChainBlock {
+		status.fate = fateBlue
+		status.chain = true
+		return status
+	}
+	queue := append([]string(nil), block.VerboseData.ChildrenHashes...)
+	visited := map[string]struct{}{}
+	for lookups := 0; len(queue) > 0 && lookups < blockLookupLimit; {
+		child := queue[0]
+		queue = queue[1:]
+		if _, done := visited[child]; done {
+			continue
+		}
+		visited[child] = struct{}{}
+		lookups++
+		descendant, err := bt.lookup(child)
+		if err != nil || descendant == nil || descendant.VerboseData == nil {
+			continue
+		}
+		if descendant.VerboseData.IsChainBlock {
+			if containsHash(descendant.VerboseData.MergeSetBluesHashes, hash) {
+				status.fate = fateBlue
+				return status
+			}
+			if containsHash(descendant.VerboseData.MergeSetRedsHashes, hash) {
+				status.fate = fateRed
+				return status
+			}
+		}
+		queue = append(queue, descendant.VerboseData.ChildrenHashes...)
+	}
+	return status
+}
+
+func containsHash(hashes []string, hash string) bool {
+	for _, h := range hashes {
+		if strings.EqualFold(h, hash) {
+			return true
+		}
+	}
+	return false
+}
+
+// finish settles a block's fate, the lock must be held
+func (bt *blockTracker) finish(tracked *TrackedBlock, fate blockFate) {
+	tracked.Fate = fate
+	tracked.Final = true
+	bt.count(tracked.Worker, fatePending, -1)
+	bt.count(tracked.Worker, fate, 1)
+	RecordBlockFate(tracked.labels, string(fate))
+	tracked.labels = nil
+	bt.finished = append(bt.finished, tracked)
+	if len(bt.finished) > trackedBlockHistory {
+		bt.finished[0] = nil
+		bt.finished = bt.finished[1:]
+	}
+}
+
+func (bt *blockTracker) count(worker string, fate blockFate, delta int64) {
+	totals, exists := bt.totals[worker]
+	if !exists {
+		totals = map[blockFate]int64{}
+		bt.totals[worker] = totals
+	}
+	totals[fate] += delta
+}
+
+// BlockReport is the tracker's state as served over http
+type BlockReport struct {
+	Workers map[string]map[blockFate]int64 `json:"workers"`
+	Blocks  []TrackedBlock                 `json:"blocks"`
+}
+
+// Report returns the totals per worker and the pending and recently settled
+// blocks, newest first, optionally only those of a worker or wallet
+func (bt *blockTracker) Report(worker, wallet string) BlockReport {
+	report := BlockReport{Workers: map[string]map[blockFate]int64{}, Blocks: []TrackedBlock{}}
+	if bt == nil {
+		return report
+	}
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	for name, totals := range bt.totals {
+		if worker != "" && name != worker {
+			continue
+		}
+		copied := map[blockFate]int64{}
+		for fate, n := range totals {
+			copied[fate] = n
+		}
+		report.Workers[name] = copied
+	}
+	add := func(blocks []*TrackedBlock) {
+		for i := len(blocks) - 1; i >= 0; i-- {
+			b := blocks[i]
+			if (worker != "" && b.Worker != worker) || (wallet != "" && b.Wallet != wallet) {
+				continue
+			}
+			report.Blocks = append(report.Blocks, *b)
+		}
+	}
+	add(bt.pending)
+	add(bt.finished)
+	return report
+}
+
+// registerBlockTrackerHandlers serves the tracker's report
+// GET /miner/blocks?worker=<WorkerName>&wallet=<hoosat:..>
+func registerBlockTrackerHandlers(bt *blockTracker) {
+	http.HandleFunc("/miner/blocks", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		report := bt.Report(strings.TrimSpace(q.Get("worker")), strings.TrimSpace(q.Get("wallet")))
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			http.Error(w, "failed to encode report", http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,136 @@
+package htnstratum
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/Hoosat-Oy/HTND/app/appmessage"
+	"github.com/Hoosat-Oy/HTND/domain/consensus/model/externalapi"
+	"github.com/Hoosat-Oy/HTND/domain/consensus/utils/blockheader"
+	"github.com/Hoosat-Oy/HTND/domain/consensus/utils/consensushashing"
+	"github.com/Hoosat-Oy/htn-stratum-bridge/src/gostratum"
+	"go.uber.org/zap"
+)
+
+func TestBlockTracker(t *testing.T) {
+	dag := map[string]*appmessage.RPCBlockVerboseData{}
+	lookup := func(hash string) (*appmessage.RPCBlock, error) {
+		if data, exists := dag[hash]; exists {
+			return &appmessage.RPCBlock{VerboseData: data}, nil
+		}
+		return nil, fmt.Errorf("block %s not found", hash)
+	}
+	tip := newChainTip()
+	now := time.Now()
+	bt := newBlockTracker(lookup, tip)
+	bt.clock = func() time.Time { return now }
+	bt.confirmations = 10
+
+	ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	ctx.WorkerName = "worker"
+	ctx.WalletAddr = "hoosat:wallet"
+	submit := func(nonce uint64, reason appmessage.RejectReason, err error) string {
+		header := blockheader.NewImmutableBlockHeader(1, nil, &externalapi.DomainHash{}, &externalapi.DomainHash{},
+			&externalapi.DomainHash{}, 0, 0, nonce, 0, 100, big.NewInt(0), &externalapi.DomainHash{})
+		block := &externalapi.DomainBlock{Header: header}
+		bt.Track(ctx, block, 1, reason, err)
+		return consensushashing.BlockHash(block).String()
+	}
+	fates := func() map[string]TrackedBlock {
+		out := map[string]TrackedBlock{}
+		for _, b := range bt.Report("", "").Blocks {
+			out[b.Hash] = b
+		}
+		return out
+	}
+
+	none := appmessage.RejectReasonNone
+	chain := submit(1, none, nil)
+	blue := submit(2, none, nil)
+	red := submit(3, none, nil)
+	unmerged := submit(4, none, nil)
+	lost := submit(5, none, nil)
+	rejected := submit(6, appmessage.RejectReasonBlockInvalid, fmt.Errorf("block rejected: ErrInvalidPoW"))
+	if b := fates()[rejected]; b.Fate != fateOrphaned || !b.Final {
+		t.Fatalf("rejected block not orphaned straight away: %+v", b)
+	}
+	// the node already having a block isn't a rejection, one that is
+	// tracked already isn't tracked twice
+	duplicateErr := fmt.Errorf("block rejected: ErrDuplicateBlock: block already exists")
+	submit(1, appmessage.RejectReasonBlockInvalid, duplicateErr)
+	duplicate := submit(7, appmessage.RejectReasonBlockInvalid, duplicateErr)
+	// the node may have accepted a block whose submit timed out
+	timedOut := submit(8, none, fmt.Errorf("timeout waiting for response"))
+	for _, hash := range []string{duplicate, timedOut} {
+		if b := fates()[hash]; b.Fate != fatePending || b.Final {
+			t.Fatalf("block %s not left pending: %+v", hash, b)
+		}
+	}
+	// resent after the timeout and accepted, still the one block
+	submit(8, none, nil)
+	if len(bt.pending) != 7 {
+		t.Fatalf("expected 7 pending blocks, got %d", len(bt.pending))
+	}
+	if b := fates()[timedOut]; b.Reason != "" {
+		t.Fatalf("accepted resend still carries the submit error: %q", b.Reason)
+	}
+
+	// blue and red are decided by the first chain descendant merging them,
+	// the non chain child in between doesn't count
+	dag[chain] = &appmessage.RPCBlockVerboseData{BlueScore: 100, IsChainBlock: true, ChildrenHashes: []string{"side"}}
+	dag[blue] = &appmessage.RPCBlockVerboseData{BlueScore: 100, ChildrenHashes: []string{"side"}}
+	dag[red] = &appmessage.RPCBlockVerboseData{BlueScore: 100, ChildrenHashes: []string{"merger"}}
+	dag[unmerged] = &appmessage.RPCBlockVerboseData{BlueScore: 100}
+	dag[duplicate] = &appmessage.RPCBlockVerboseData{BlueScore: 100, IsChainBlock: true}
+	dag[timedOut] = &appmessage.RPCBlockVerboseData{BlueScore: 100, ChildrenHashes: []string{"merger"}}
+	dag["side"] = &appmessage.RPCBlockVerboseData{ChildrenHashes: []string{"merger"}, MergeSetRedsHashes: []string{blue}}
+	dag["merger"] = &appmessage.RPCBlockVerboseData{IsChainBlock: true,
+		MergeSetBluesHashes: []string{blue, timedOut}, MergeSetRedsHashes: []string{red}}
+
+	tip.Update(105)
+	bt.Check()
+	current := fates()
+	for hash, fate := range map[string]blockFate{chain: fateBlue, blue: fateBlue, red: fateRed, unmerged: fatePending,
+		lost: fatePending, duplicate: fateBlue, timedOut: fateBlue} {
+		if b := current[hash]; b.Fate != fate || b.Final {
+			t.Fatalf("expected %s to be pending final fate %s, got %+v", hash, fate, b)
+		}
+	}
+	if b := current[red]; b.Confirmations != 5 {
+		t.Fatalf("expected 5 confirmations, got %d", b.Confirmations)
+	}
+	if !current[chain].Chain || current[blue].Chain {
+		t.Fatalf("chain flag wrong")
+	}
+
+	// settled once deep enough, a block the node never knew is orphaned
+	// after the timeout and one never merged once deep enough
+	now = now.Add(time.Minute)
+	tip.Update(110)
+	bt.Check()
+	current = fates()
+	for hash, fate := range map[string]blockFate{chain: fateBlue, blue: fateBlue, red: fateRed, unmerged: fateOrphaned,
+		lost: fateOrphaned, duplicate: fateBlue, timedOut: fateBlue} {
+		if b := current[hash]; b.Fate != fate || !b.Final {
+			t.Fatalf("expected %s to be settled as %s, got %+v", hash, fate, b)
+		}
+	}
+	if len(bt.pending) != 0 {
+		t.Fatalf("settled blocks still pending")
+	}
+	for _, b := range bt.finished {
+		if b.labels != nil {
+			t.Fatalf("settled block %s still holds its worker's labels", b.Hash)
+		}
+	}
+	totals := bt.Report("worker", "").Workers["worker"]
+	if totals[fateBlue] != 4 || totals[fateRed] != 1 || totals[fateOrphaned] != 3 || totals[fatePending] != 0 {
+		t.Fatalf("unexpected totals %v", totals)
+	}
+	if len(bt.Report("other", "").Blocks) != 0 || len(bt.Report("", "hoosat:wallet").Blocks) != 8 {
+		t.Fatalf("report filters not applied")
+	}
+}
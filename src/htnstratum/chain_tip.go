@@ -0,0 +1,92 @@
+package htnstratum
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// the default max difference between tip blue score and job blue score that
+// we'll accept, anything greater than this is considered a stale
+const defaultStaleBlueScoreWindow = 8
+
+// how many tip advances are remembered for time based windows, about two
+// minutes at 5 blocks per second
+const tipHistory = 600
+
+// staleWindow is how far the chain may move past a job before shares for it
+// are stale, in blue score or, if duration is set, in time since the chain
+// reached the job's blue score
+type staleWindow struct {
+	blueScore uint64
+	duration  time.Duration
+}
+
+type tipAdvance struct {
+	blueScore uint64
+	at        time.Time
+}
+
+// chainTip follows the node's virtual selected parent blue score. A nil tip,
+// or one that hasn't heard from the node yet, considers nothing stale
+type chainTip struct {
+	lock     sync.RWMutex
+	advances []tipAdvance // ascending blue score
+	clock    func() time.Time
+}
+
+func newChainTip() *chainTip {
+	return &chainTip{clock: time.Now}
+}
+
+// Update records the node's new blue score, going backwards (a reorg to a
+// lower scoring chain) is ignored
+func (ct *chainTip) Update(blueScore uint64) {
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+	if n := len(ct.advances); n > 0 && blueScore <= ct.advances[n-1].blueScore {
+		return
+	}
+	ct.advances = append(ct.advances, tipAdvance{blueScore: blueScore, at: ct.clock()})
+	if len(ct.advances) > tipHistory {
+		ct.advances = append(ct.advances[:0], ct.advances[len(ct.advances)-tipHistory:]...)
+	}
+	RecordChainTip(blueScore)
+}
+
+// BlueScore is the latest blue score from the node, false if there's none yet
+func (ct *chainTip) BlueScore() (uint64, bool) {
+	if ct == nil {
+		return 0, false
+	}
+	ct.lock.RLock()
+	defer ct.lock.RUnlock()
+	if len(ct.advances) == 0 {
+		return 0, false
+	}
+	return ct.advances[len(ct.advances)-1].blueScore, true
+}
+
+// IsStale says whether work at the blue score is outside the window
+func (ct *chainTip) IsStale(blueScore uint64, window staleWindow) bool {
+	if ct == nil {
+		return false
+	}
+	ct.lock.RLock()
+	defer ct.lock.RUnlock()
+	n := len(ct.advances)
+	if n == 0 {
+		return false
+	}
+	if window.duration <= 0 {
+		tip := ct.advances[n-1].blueScore
+		return tip > blueScore && tip-blueScore > window.blueScore
+	}
+	// when the chain first reached the job's blue score, if it's older than
+	// the history the oldest advance is the conservative answer
+	i := sort.Search(n, func(i int) bool { return ct.advances[i].blueScore >= blueScore })
+	if i == n {
+		return false
+	}
+	return ct.clock().Sub(ct.advances[i].at) > window.duration
+}
@@ -0,0 +1,59 @@
+package htnstratum
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChainTip(t *testing.T) {
+	var nilTip *chainTip
+	if nilTip.IsStale(1, staleWindow{blueScore: 8}) {
+		t.Fatalf("nil tip considered a share stale")
+	}
+
+	now := time.Now()
+	ct := newChainTip()
+	ct.clock = func() time.Time { return now }
+	blocks := staleWindow{blueScore: 8}
+	if ct.IsStale(1, blocks) {
+		t.Fatalf("share stale before the node reported a tip")
+	}
+	if _, known := ct.BlueScore(); known {
+		t.Fatalf("blue score known before any update")
+	}
+
+	// blue score window
+	ct.Update(100)
+	ct.Update(90) // backwards, ignored
+	if tip, _ := ct.BlueScore(); tip != 100 {
+		t.Fatalf("expected tip 100, got %d", tip)
+	}
+	if ct.IsStale(92, blocks) || ct.IsStale(100, blocks) || ct.IsStale(105, blocks) {
+		t.Fatalf("share within the window considered stale")
+	}
+	if !ct.IsStale(91, blocks) {
+		t.Fatalf("share outside the window not considered stale")
+	}
+
+	// time window, measured from when the tip reached the job's blue score
+	ct.advances = nil
+	ct.Update(200)
+	now = now.Add(time.Second)
+	ct.Update(210)
+	now = now.Add(time.Second)
+	ct.Update(220)
+	seconds := staleWindow{blueScore: 8, duration: 1500 * time.Millisecond}
+	if !ct.IsStale(200, seconds) {
+		t.Fatalf("share from 2s ago not considered stale")
+	}
+	if ct.IsStale(205, seconds) || ct.IsStale(210, seconds) {
+		t.Fatalf("share from 1s ago considered stale")
+	}
+	if ct.IsStale(230, seconds) {
+		t.Fatalf("share ahead of the tip considered stale")
+	}
+	now = now.Add(time.Second)
+	if !ct.IsStale(210, seconds) || ct.IsStale(220, seconds) {
+		t.Fatalf("time window not following the clock")
+	}
+}
@@ -2,8 +2,6 @@ package htnstratum
 
 import (
 	"fmt"
-	"math"
-	"regexp"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -14,192 +12,219 @@ import (
 	"go.uber.org/zap"
 )
 
-var bigJobRegex = regexp.MustCompile(".*BzMiner.*")
-
 const balanceDelay = time.Minute
 
 type clientListener struct {
 	logger           *zap.SugaredLogger
 	shareHandler     *shareHandler
+	bans             *banManager
+	profiles         *minerProfiles
 	clientLock       sync.RWMutex
 	clients          map[int32]*gostratum.StratumContext
 	lastBalanceCheck time.Time
 	clientCounter    int32
-	minShareDiff     float64
-	extranonceSize   int8
-	maxExtranonce    int32
-	nextExtranonce   int32
+	sessions         *sessionStore
+	jobs             *jobDistributor
 }
 
-func newClientListener(logger *zap.SugaredLogger, shareHandler *shareHandler, minShareDiff float64, extranonceSize int8) *clientListener {
+func newClientListener(logger *zap.SugaredLogger, shareHandler *shareHandler, bans *banManager, profiles *minerProfiles) *clientListener {
 	return &clientListener{
-		logger:         logger,
-		minShareDiff:   minShareDiff,
-		extranonceSize: extranonceSize,
-		maxExtranonce:  int32(math.Pow(2, (8*math.Min(float64(extranonceSize), 3))) - 1),
-		nextExtranonce: 0,
-		clientLock:     sync.RWMutex{},
-		shareHandler:   shareHandler,
-		clients:        make(map[int32]*gostratum.StratumContext),
+		logger:       logger,
+		bans:         bans,
+		profiles:     profiles,
+		clientLock:   sync.RWMutex{},
+		shareHandler: shareHandler,
+		clients:      make(map[int32]*gostratum.StratumContext),
+		jobs:         newJobDistributor(defaultJobWorkers),
 	}
 }
 
 func (c *clientListener) OnConnect(ctx *gostratum.StratumContext) {
-	var extranonce int32
+	if ban, banned := c.bans.Banned(ctx.RemoteAddr, ctx.WalletAddr); banned {
+		ctx.Logger.Warn("rejecting banned client", zap.String("reason", ban.Reason))
+		sendMessage(ctx, "banned: "+banMessage(ban))
+		go ctx.Disconnect()
+		return
+	}
 
 	idx := atomic.AddInt32(&c.clientCounter, 1)
 	ctx.Id = idx
-	c.clientLock.Lock()
-	if c.extranonceSize > 0 {
-		extranonce = c.nextExtranonce
-		if c.nextExtranonce < c.maxExtranonce {
-			c.nextExtranonce++
-		} else {
-			c.nextExtranonce = 0
-			c.logger.Warn("wrapped extranonce! new clients may be duplicating work...")
-		}
+	ctx.Logger = ctx.Logger.With(zap.Int("client_id", int(ctx.Id)))
+	extranonce, err := GetMiningState(ctx).Port().extranonces.Allocate(idx)
+	if err != nil {
+		// handing out a duplicate would have two miners doing the same work
+		ctx.Logger.Error("refusing client, every extranonce is in use")
+		go ctx.Disconnect()
+		return
 	}
+	ctx.Extranonce = extranonce
+	c.clientLock.Lock()
 	c.clients[idx] = ctx
 	c.clientLock.Unlock()
-	ctx.Logger = ctx.Logger.With(zap.Int("client_id", int(ctx.Id)))
-
-	if c.extranonceSize > 0 {
-		ctx.Extranonce = fmt.Sprintf("%0*x", c.extranonceSize*2, extranonce)
-	}
 	go func() {
 		// hacky, but give time for the authorize to go through so we can use the worker name
-		time.Sleep(5 * time.Second)
+		select {
+		case <-ctx.Done():
+			return // gone before authorizing, nothing to track
+		case <-time.After(5 * time.Second):
+		}
 		c.shareHandler.getCreateStats(ctx) // create the stats if they don't exist
 	}()
 }
 
 func (c *clientListener) OnDisconnect(ctx *gostratum.StratumContext) {
-	ctx.Done()
 	c.clientLock.Lock()
 	c.logger.Info("removing client ", ctx.Id)
 	delete(c.clients, ctx.Id)
 	c.logger.Info("removed client ", ctx.Id)
 	c.clientLock.Unlock()
+	c.sessions.Detach(ctx)
+	c.jobs.Remove(ctx)
+	GetMiningState(ctx).Port().extranonces.Release(ctx.Id)
+	if ctx.DisconnectReason() == gostratum.DisconnectAuthorizeTimeout {
+		// this happens pretty frequently in gcp/aws land since script-kiddies scrape ports
+		ctx.Logger.Warn("client misconfigured, no miner address specified", zap.String("client", ctx.String()))
+		RecordWorkerError(ctx.WalletAddr, ErrNoMinerAddress)
+	}
 	RecordDisconnect(ctx)
 }
 
-func (c *clientListener) NewBlockAvailable(htnApi *HtnApi, soloMining bool, poll int64, vote int64) {
-	c.clientLock.Lock()
-	addresses := make([]string, 0, len(c.clients))
+func (c *clientListener) OnMalformed(ctx *gostratum.StratumContext, err error) {
+	c.bans.RecordMalformed(ctx)
+}
+
+// disconnectBanned boots every connected client covered by a new ban
+func (c *clientListener) disconnectBanned(ban *BanEntry) {
+	var banned []*gostratum.StratumContext
+	c.clientLock.RLock()
 	for _, cl := range c.clients {
-		if !cl.Connected() {
-			continue
+		if ban.matches(cl) {
+			banned = append(banned, cl)
 		}
-		go func(client *gostratum.StratumContext) {
-			state := GetMiningState(client)
-			if client.WalletAddr == "" {
-				if time.Since(state.connectTime) > time.Second*20 { // timeout passed
-					// this happens pretty frequently in gcp/aws land since script-kiddies scrape ports
-					client.Logger.Warn("client misconfigured, no miner address specified - disconnecting", zap.String("client", client.String()))
-					RecordWorkerError(client.WalletAddr, ErrNoMinerAddress)
-					client.Disconnect() // invalid configuration, boot the worker
-				}
-				return
-			}
-			template, err := htnApi.GetBlockTemplate(client, poll, vote)
-			if err != nil {
-				if strings.Contains(err.Error(), "Could not decode address") {
-					RecordWorkerError(client.WalletAddr, ErrInvalidAddressFmt)
-					client.Logger.Error(fmt.Sprintf("failed fetching new block template from hoosat, malformed address: %s", err))
-					client.Disconnect() // unrecoverable
-				} else {
-					RecordWorkerError(client.WalletAddr, ErrFailedBlockFetch)
-					client.Logger.Error(fmt.Sprintf("failed fetching new block template from hoosat: %s", err))
-				}
-				return
-			}
-			state.bigDiff = CalculateTarget(uint64(template.Block.Header.Bits))
-			header, err := SerializeBlockHeader(template.Block)
-			if err != nil {
-				RecordWorkerError(client.WalletAddr, ErrBadDataFromMiner)
-				client.Logger.Error(fmt.Sprintf("failed to serialize block header: %s", err))
-				return
-			}
-
-			jobId := state.AddJob(template.Block)
-			if !state.initialized {
-				state.initialized = true
-				state.useBigJob = bigJobRegex.MatchString(client.RemoteApp)
-				// first pass through send the difficulty since it's fixed
-				state.stratumDiff = newHoosatDiff()
-				state.stratumDiff.setDiffValue(c.minShareDiff)
-				if !soloMining {
-					sendClientDiff(client, state)
-				}
-				c.shareHandler.setClientVardiff(client, c.minShareDiff)
-			}
-
-			varDiff := TargetToDiff(&state.bigDiff)
-			c.shareHandler.setSoloDiff(varDiff)
-			if !soloMining {
-				varDiff = c.shareHandler.getClientVardiff(client)
-			}
-
-			// Guard against race where stratumDiff isn't initialized yet
-			currentDiff := 0.0
-			if state.stratumDiff != nil {
-				currentDiff = state.stratumDiff.diffValue
-			}
-
-			if varDiff == 0 {
-				// If vardiff not computed, fall back to current or default
-				if state.stratumDiff == nil {
-					state.stratumDiff = newHoosatDiff()
-					state.stratumDiff.setDiffValue(c.minShareDiff)
-					currentDiff = state.stratumDiff.diffValue
-				}
-				varDiff = currentDiff
-			}
+	}
+	c.clientLock.RUnlock()
+	for _, cl := range banned {
+		sendMessage(cl, "banned: "+banMessage(ban))
+		go cl.Disconnect()
+	}
+}
 
-			if state.stratumDiff == nil || varDiff != currentDiff {
-				// send updated vardiff
-				if state.stratumDiff == nil {
-					state.stratumDiff = newHoosatDiff()
-				}
-				if !soloMining {
-					client.Logger.Info(fmt.Sprintf("changing diff from %.10f to %.10f", currentDiff, varDiff))
-				}
-				state.stratumDiff.setDiffValue(varDiff)
-				sendClientDiff(client, state)
-				c.shareHandler.startClientVardiff(client)
-			}
-
-			jobParams := []any{fmt.Sprintf("%d", jobId)}
-			if state.useBigJob {
-				jobParams = append(jobParams, GenerateLargeJobParams(header, uint64(template.Block.Header.Timestamp)))
-			} else {
-				jobParams = append(jobParams, GenerateJobHeader(header))
-				jobParams = append(jobParams, template.Block.Header.Timestamp)
-			}
-
-			// // normal notify flow
-			if err := client.Send(gostratum.JsonRpcEvent{
-				Version: "2.0",
-				Method:  "mining.notify",
-				Id:      jobId,
-				Params:  jobParams,
-			}); err != nil {
-				if errors.Is(err, gostratum.ErrorDisconnected) {
-					RecordWorkerError(client.WalletAddr, ErrDisconnected)
-					return
-				}
-				RecordWorkerError(client.WalletAddr, ErrFailedSendWork)
-				client.Logger.Error(errors.Wrapf(err, "failed sending work packet %d", jobId).Error())
-			}
+// broadcastReconnect asks every connected miner to reconnect, to host:port if
+// given, so they can move over before the bridge goes away
+func (c *clientListener) broadcastReconnect(host string, port string) {
+	c.clientLock.RLock()
+	defer c.clientLock.RUnlock()
+	for _, cl := range c.clients {
+		if err := gostratum.SendReconnect(cl, host, port, 0); err != nil {
+			cl.Logger.Warn("failed sending reconnect", zap.Error(err))
+		}
+	}
+}
+
+// waitForClients blocks until every client has disconnected or the deadline
+// passes, returning the number still connected
+func (c *clientListener) waitForClients(deadline time.Time) int {
+	for {
+		c.clientLock.RLock()
+		remaining := len(c.clients)
+		c.clientLock.RUnlock()
+		if remaining == 0 || time.Now().After(deadline) {
+			return remaining
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// matchProfile is the profile forced by the miner's port, or the one
+// matching its user agent
+func (c *clientListener) matchProfile(ctx *gostratum.StratumContext) *MinerProfile {
+	if profile := GetMiningState(ctx).Port().profile; profile != nil {
+		return profile
+	}
+	return c.profiles.Match(ctx.RemoteApp)
+}
+
+// assignProfile picks the miner profile once the user agent is known from
+// mining.subscribe
+func (c *clientListener) assignProfile(ctx *gostratum.StratumContext) {
+	state := GetMiningState(ctx)
+	state.profile = c.matchProfile(ctx)
+	if state.profile.ExtranonceMode == ExtranonceModeNone {
+		state.Port().extranonces.Release(ctx.Id)
+		ctx.Extranonce = ""
+	}
+	ctx.Logger.Info(fmt.Sprintf("using miner profile %s for '%s'", state.profile.Name, ctx.RemoteApp))
+}
+
+// resumeSession restores the miner's previous session if it presented one
+// that's still within the grace period, otherwise the client keeps the
+// session it has or a new one is started
+func (c *clientListener) resumeSession(ctx *gostratum.StratumContext, requested string) bool {
+	if c.sessions == nil {
+		return false
+	}
+	port := GetMiningState(ctx).Port()
+	previous := ctx.SessionId
+	session, resumed := c.sessions.Resume(ctx, requested)
+	if session.id != previous {
+		RecordSession(resumed)
+	}
+	if ctx.Extranonce != "" && c.matchProfile(ctx).ExtranonceMode != ExtranonceModeNone {
+		if extranonce, moved := port.extranonces.PinSession(ctx.Id, session.id, c.sessions.grace); moved {
+			ctx.Extranonce = extranonce
+		}
+	}
+	if previous != "" && previous != session.id {
+		// the session the client had until now is gone
+		port.extranonces.UnpinSession(ctx.Id, previous)
+	}
+	if resumed {
+		ctx.Logger.Info(fmt.Sprintf("resumed session %s", session.id))
+	}
+	return resumed
+}
 
-			RecordNewJob(client)
-		}(cl)
+// pinExtranonce ties the client's extranonce to its wallet.worker, moving it
+// back onto the one it had before if it's reconnecting
+func (c *clientListener) pinExtranonce(ctx *gostratum.StratumContext, wallet string, worker string) {
+	if ctx.Extranonce == "" {
+		return
+	}
+	extranonce, moved := GetMiningState(ctx).Port().extranonces.Pin(ctx.Id, wallet+"."+worker)
+	if !moved {
+		return
+	}
+	ctx.Logger.Info(fmt.Sprintf("restoring pinned extranonce %s", extranonce))
+	if err := gostratum.SetExtranonce(ctx, extranonce); err != nil {
+		ctx.Logger.Error("failed sending pinned extranonce", zap.Error(err))
+	}
+}
+
+func (c *clientListener) OnReject(addr string, reason gostratum.RejectReason) {
+	RecordConnectionRejected(reason)
+}
+
+// NewBlockAvailable sends every client a job for the template announced at
+// available
+func (c *clientListener) NewBlockAvailable(htnApi *HtnApi, available time.Time, poll int64, vote int64) {
+	c.clientLock.RLock()
+	addresses := make([]string, 0, len(c.clients))
+	for _, cl := range c.clients {
+		// until it has subscribed the client's mining state may still be
+		// swapped for a resumed session's, so it gets no jobs before then
+		if !cl.Connected() || !(cl.Subscribed() || cl.Authorized()) {
+			continue
+		}
+		client := cl
+		c.jobs.Schedule(client, func() {
+			c.sendJob(htnApi, client, poll, vote, available)
+		})
 
 		if cl.WalletAddr != "" {
 			addresses = append(addresses, cl.WalletAddr)
 		}
 	}
-	c.clientLock.Unlock()
+	c.clientLock.RUnlock()
 
 	if time.Since(c.lastBalanceCheck) > balanceDelay {
 		c.lastBalanceCheck = time.Now()
@@ -216,12 +241,116 @@ func (c *clientListener) NewBlockAvailable(htnApi *HtnApi, soloMining bool, poll
 	}
 }
 
-func sendClientDiff(client *gostratum.StratumContext, state *MiningState) {
+// sendJob sends the client a job for the newest template, run by the job
+// distributor so never concurrently for the same client
+func (c *clientListener) sendJob(htnApi *HtnApi, client *gostratum.StratumContext, poll int64, vote int64, available time.Time) {
+	state := GetMiningState(client)
+	port := state.Port()
+	soloMining := port.soloMining
+	if client.WalletAddr == "" {
+		return // not authorized yet, the listener boots it if it never does
+	}
+	template, err := htnApi.GetBlockTemplate(client, poll, vote)
+	if client.Err() != nil {
+		return // disconnected while fetching, don't bother with the job
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "Could not decode address") {
+			RecordWorkerError(client.WalletAddr, ErrInvalidAddressFmt)
+			client.Logger.Error(fmt.Sprintf("failed fetching new block template from hoosat, malformed address: %s", err))
+			client.Disconnect() // unrecoverable
+		} else {
+			RecordWorkerError(client.WalletAddr, ErrFailedBlockFetch)
+			client.Logger.Error(fmt.Sprintf("failed fetching new block template from hoosat: %s", err))
+		}
+		return
+	}
+	state.bigDiff = CalculateTarget(uint64(template.Block.Header.Bits))
+	header, err := SerializeBlockHeader(template.Block)
+	if err != nil {
+		RecordWorkerError(client.WalletAddr, ErrBadDataFromMiner)
+		client.Logger.Error(fmt.Sprintf("failed to serialize block header: %s", err))
+		return
+	}
+
+	if !state.initialized {
+		state.initialized = true
+		// first pass through send the difficulty since it's fixed
+		state.setDiff(port.minShareDiff)
+		if !soloMining {
+			sendClientDiff(client, state)
+		}
+		c.shareHandler.setClientVardiff(client, port.minShareDiff)
+	}
+
+	varDiff := TargetToDiff(&state.bigDiff)
+	c.shareHandler.setSoloDiff(varDiff)
+	if !soloMining {
+		varDiff = c.shareHandler.getClientVardiff(client)
+	}
+
+	// Guard against race where stratumDiff isn't initialized yet
+	currentDiff := 0.0
+	if state.stratumDiff != nil {
+		currentDiff = state.stratumDiff.diffValue
+	}
+
+	if varDiff == 0 {
+		// If vardiff not computed, fall back to current or default
+		if state.stratumDiff == nil {
+			state.setDiff(port.minShareDiff)
+			currentDiff = state.stratumDiff.diffValue
+		}
+		varDiff = currentDiff
+	}
+
+	profile := state.Profile()
+	if state.stratumDiff == nil || varDiff != currentDiff {
+		// send updated vardiff
+		if !soloMining {
+			client.Logger.Info(fmt.Sprintf("changing diff from %.10f to %.10f", currentDiff, varDiff))
+		}
+		state.setDiff(varDiff)
+		sendClientDiff(client, state)
+		c.shareHandler.startClientVardiff(client)
+	} else if profile.HasQuirk(QuirkResendDiff) {
+		sendClientDiff(client, state)
+	}
+
+	// the job is bound to the difficulty the miner was just sent
+	jobId := state.AddJob(template.Block)
+	jobParams := profile.jobParams(jobId, header, template.Block.Header.Timestamp)
+
+	// // normal notify flow
 	if err := client.Send(gostratum.JsonRpcEvent{
 		Version: "2.0",
-		Method:  "mining.set_difficulty",
-		Params:  []any{state.stratumDiff.diffValue},
+		Method:  "mining.notify",
+		Id:      jobId,
+		Params:  jobParams,
 	}); err != nil {
+		if errors.Is(err, gostratum.ErrorDisconnected) {
+			RecordWorkerError(client.WalletAddr, ErrDisconnected)
+			return
+		}
+		RecordWorkerError(client.WalletAddr, ErrFailedSendWork)
+		client.Logger.Error(errors.Wrapf(err, "failed sending work packet %d", jobId).Error())
+	}
+
+	RecordNewJob(client)
+	RecordJobDistribution(time.Since(available))
+}
+
+// sendMessage shows the message in the miner's console unless its profile
+// says it can't cope with that
+func sendMessage(client *gostratum.StratumContext, message string) {
+	if GetMiningState(client).Profile().HasQuirk(QuirkNoShowMessage) {
+		return
+	}
+	gostratum.SendMessage(client, message)
+}
+
+func sendClientDiff(client *gostratum.StratumContext, state *MiningState) {
+	if err := client.Send(state.Profile().diffEvent(state.stratumDiff)); err != nil {
 		RecordWorkerError(client.WalletAddr, ErrFailedSetDiff)
 		client.Logger.Error(errors.Wrap(err, "failed sending difficulty").Error())
 		return
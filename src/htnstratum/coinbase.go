@@ -0,0 +1,216 @@
+package htnstratum
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sync"
+
+	"github.com/Hoosat-Oy/HTND/app/appmessage"
+	"github.com/Hoosat-Oy/HTND/domain/consensus/model/externalapi"
+	"github.com/Hoosat-Oy/HTND/domain/consensus/processes/coinbasemanager"
+	"github.com/Hoosat-Oy/HTND/domain/consensus/utils/consensushashing"
+	"github.com/Hoosat-Oy/HTND/domain/consensus/utils/hashes"
+	"github.com/Hoosat-Oy/HTND/domain/consensus/utils/txscript"
+	"github.com/Hoosat-Oy/HTND/util"
+	"github.com/pkg/errors"
+)
+
+// matches the node's coinbase payload limit, longer scripts are rejected
+const coinbaseScriptPublicKeyMaxLength = 150
+
+// localTemplate is a template fetched for a placeholder address that every
+// miner's block is built from, by swapping its own script and extra data into
+// the coinbase. Only the coinbase and the hash merkle root differ between
+// miners, the rest of the header commits to the parents' state
+type localTemplate struct {
+	source      *appmessage.GetBlockTemplateResponseMessage
+	block       *appmessage.RPCBlock
+	coinbase    *externalapi.DomainTransaction
+	placeholder *externalapi.ScriptPublicKey
+	branch      []*externalapi.DomainHash // merkle siblings of the coinbase, bottom up
+}
+
+func newLocalTemplate(source *appmessage.GetBlockTemplateResponseMessage, placeholder *externalapi.ScriptPublicKey) (*localTemplate, error) {
+	if source.Block == nil || len(source.Block.Transactions) == 0 {
+		return nil, fmt.Errorf("block template has no coinbase transaction")
+	}
+	txHashes := make([]*externalapi.DomainHash, len(source.Block.Transactions))
+	var coinbase *externalapi.DomainTransaction
+	for i, rpcTx := range source.Block.Transactions {
+		tx, err := appmessage.RPCTransactionToDomainTransaction(rpcTx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed decoding template transaction %d", i)
+		}
+		if i == 0 {
+			coinbase = tx
+		}
+		txHashes[i] = consensushashing.TransactionHash(tx)
+	}
+	return &localTemplate{
+		source:      source,
+		block:       source.Block,
+		coinbase:    coinbase,
+		placeholder: placeholder,
+		branch:      coinbaseMerkleBranch(txHashes),
+	}, nil
+}
+
+// build returns the template with the coinbase paying the script and carrying
+// the extra data
+func (lt *localTemplate) build(script *externalapi.ScriptPublicKey, extraData []byte) (*appmessage.RPCBlock, error) {
+	coinbase := lt.coinbase.Clone()
+	coinbaseData := &externalapi.DomainCoinbaseData{ScriptPublicKey: script, ExtraData: extraData}
+	payload, err := coinbasemanager.ModifyCoinbasePayload(coinbase.Payload, coinbaseData, coinbaseScriptPublicKeyMaxLength)
+	if err != nil {
+		return nil, err
+	}
+	coinbase.Payload = payload
+	// the reward for merged red blocks goes to this block's miner, the other
+	// outputs pay the miners of merged blue blocks and stay as they are
+	for _, output := range coinbase.Outputs {
+		if output.ScriptPublicKey.Equal(lt.placeholder) {
+			output.ScriptPublicKey = script
+		}
+	}
+
+	header := *lt.block.Header
+	header.HashMerkleRoot = merkleRootFromBranch(consensushashing.TransactionHash(coinbase), lt.branch).String()
+	transactions := make([]*appmessage.RPCTransaction, len(lt.block.Transactions))
+	copy(transactions, lt.block.Transactions)
+	transactions[0] = appmessage.DomainTransactionToRPCTransaction(coinbase)
+	return &appmessage.RPCBlock{
+		Header:       &header,
+		Transactions: transactions,
+		VerboseData:  lt.block.VerboseData,
+	}, nil
+}
+
+func hashMerkleBranches(left, right *externalapi.DomainHash) *externalapi.DomainHash {
+	w := hashes.NewMerkleBranchHashWriter()
+	w.InfallibleWrite(left.ByteSlice())
+	w.InfallibleWrite(right.ByteSlice())
+	return w.Finalize()
+}
+
+// coinbaseMerkleBranch returns the sibling on each level of the path from the
+// first leaf to the root, nil where the sibling is empty, laid out the same
+// way the node builds the tree
+func coinbaseMerkleBranch(txHashes []*externalapi.DomainHash) []*externalapi.DomainHash {
+	var branch []*externalapi.DomainHash
+	level := txHashes
+	for len(level) > 1 {
+		if len(level)%2 == 1 {
+			level = append(level, nil)
+		}
+		branch = append(branch, level[1])
+		next := make([]*externalapi.DomainHash, 0, len(level)/2)
+		for i := 0; i < len(level); i += 2 {
+			if level[i+1] == nil {
+				next = append(next, hashMerkleBranches(level[i], &externalapi.DomainHash{}))
+				continue
+			}
+			next = append(next, hashMerkleBranches(level[i], level[i+1]))
+		}
+		level = next
+	}
+	return branch
+}
+
+func merkleRootFromBranch(coinbaseHash *externalapi.DomainHash, branch []*externalapi.DomainHash) *externalapi.DomainHash {
+	root := coinbaseHash
+	for _, sibling := range branch {
+		if sibling == nil {
+			sibling = &externalapi.DomainHash{}
+		}
+		root = hashMerkleBranches(root, sibling)
+	}
+	return root
+}
+
+// coinbaseBuilder turns the one template fetched per block into a block for
+// each miner
+type coinbaseBuilder struct {
+	lock         sync.Mutex
+	placeholders map[util.Bech32Prefix]util.Address
+	current      *localTemplate
+}
+
+func newCoinbaseBuilder() *coinbaseBuilder {
+	return &coinbaseBuilder{
+		placeholders: map[util.Bech32Prefix]util.Address{},
+	}
+}
+
+// placeholder is the address templates are fetched for. It's a random key
+// nobody holds, so any output paying it can only be this block's own reward
+func (cb *coinbaseBuilder) placeholder(prefix util.Bech32Prefix) (util.Address, error) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if address, exists := cb.placeholders[prefix]; exists {
+		return address, nil
+	}
+	key := make([]byte, util.PublicKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	address, err := util.NewAddressPublicKey(key, prefix)
+	if err != nil {
+		return nil, err
+	}
+	cb.placeholders[prefix] = address
+	return address, nil
+}
+
+// template parses the fetched template, once for all miners
+func (cb *coinbaseBuilder) template(source *appmessage.GetBlockTemplateResponseMessage, placeholder util.Address) (*localTemplate, error) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if cb.current != nil && cb.current.source == source {
+		return cb.current, nil
+	}
+	script, err := txscript.PayToAddrScript(placeholder)
+	if err != nil {
+		return nil, err
+	}
+	lt, err := newLocalTemplate(source, script)
+	if err != nil {
+		return nil, err
+	}
+	cb.current = lt
+	return lt, nil
+}
+
+// Build fetches the shared template through fetch and returns it rebuilt to
+// pay the wallet
+func (cb *coinbaseBuilder) Build(wallet string, extraData string,
+	fetch func(placeholder string) (*appmessage.GetBlockTemplateResponseMessage, error)) (*appmessage.GetBlockTemplateResponseMessage, error) {
+	address, err := util.DecodeAddress(wallet, util.Bech32PrefixUnknown)
+	if err != nil {
+		// same wording as the node so a bad wallet is handled the same way
+		return nil, errors.Wrap(err, "Could not decode address")
+	}
+	script, err := txscript.PayToAddrScript(address)
+	if err != nil {
+		return nil, err
+	}
+	placeholder, err := cb.placeholder(address.Prefix())
+	if err != nil {
+		return nil, err
+	}
+	source, err := fetch(placeholder.EncodeAddress())
+	if err != nil {
+		return nil, err
+	}
+	lt, err := cb.template(source, placeholder)
+	if err != nil {
+		return nil, err
+	}
+	block, err := lt.build(script, []byte(extraData))
+	if err != nil {
+		return nil, err
+	}
+	return &appmessage.GetBlockTemplateResponseMessage{
+		Block:    block,
+		IsSynced: source.IsSynced,
+	}, nil
+}
@@ -0,0 +1,146 @@
+package htnstratum
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/Hoosat-Oy/HTND/app/appmessage"
+	"github.com/Hoosat-Oy/HTND/domain/consensus/model/externalapi"
+	"github.com/Hoosat-Oy/HTND/domain/consensus/processes/coinbasemanager"
+	"github.com/Hoosat-Oy/HTND/domain/consensus/utils/merkle"
+	"github.com/Hoosat-Oy/HTND/domain/consensus/utils/subnetworks"
+	"github.com/Hoosat-Oy/HTND/domain/consensus/utils/txscript"
+	"github.com/Hoosat-Oy/HTND/util"
+)
+
+func testTransaction(seed byte) *externalapi.DomainTransaction {
+	return &externalapi.DomainTransaction{
+		Version: 0,
+		Inputs: []*externalapi.DomainTransactionInput{{
+			PreviousOutpoint: externalapi.DomainOutpoint{
+				TransactionID: *externalapi.NewDomainTransactionIDFromByteArray(&[externalapi.DomainHashSize]byte{seed}),
+			},
+			SignatureScript: []byte{seed},
+		}},
+		Outputs: []*externalapi.DomainTransactionOutput{{
+			Value:           uint64(seed) * 1000,
+			ScriptPublicKey: &externalapi.ScriptPublicKey{Script: []byte{seed, seed}},
+		}},
+		SubnetworkID: subnetworks.SubnetworkIDNative,
+		Payload:      []byte{},
+	}
+}
+
+func TestCoinbaseMerkleBranch(t *testing.T) {
+	for count := 1; count <= 9; count++ {
+		txs := make([]*externalapi.DomainTransaction, count)
+		for i := range txs {
+			txs[i] = testTransaction(byte(i + 1))
+		}
+		hashes := make([]*externalapi.DomainHash, count)
+		for i, tx := range txs {
+			hashes[i] = merkle.CalculateHashMerkleRoot([]*externalapi.DomainTransaction{tx})
+		}
+		branch := coinbaseMerkleBranch(hashes)
+		expected := merkle.CalculateHashMerkleRoot(txs)
+		if root := merkleRootFromBranch(hashes[0], branch); !root.Equal(expected) {
+			t.Errorf("%d transactions: expected root %s, got %s", count, expected, root)
+		}
+	}
+}
+
+func TestLocalCoinbase(t *testing.T) {
+	builder := newCoinbaseBuilder()
+	placeholder, err := builder.placeholder(util.Bech32PrefixHoosat)
+	if err != nil {
+		t.Fatalf("failed creating placeholder address: %s", err)
+	}
+	placeholderScript, _ := txscript.PayToAddrScript(placeholder)
+
+	key := make([]byte, util.PublicKeySize)
+	key[0] = 7
+	walletAddr, _ := util.NewAddressPublicKey(key, util.Bech32PrefixHoosat)
+	walletScript, _ := txscript.PayToAddrScript(walletAddr)
+	blueScript := &externalapi.ScriptPublicKey{Script: []byte{1, 2, 3}}
+
+	payload := make([]byte, 16)
+	binary.LittleEndian.PutUint64(payload, 1234)     // blue score
+	binary.LittleEndian.PutUint64(payload[8:], 5678) // subsidy
+	payload, _ = coinbasemanager.ModifyCoinbasePayload(payload, &externalapi.DomainCoinbaseData{
+		ScriptPublicKey: placeholderScript, ExtraData: []byte("template"),
+	}, coinbaseScriptPublicKeyMaxLength)
+	coinbase := &externalapi.DomainTransaction{
+		Version: 0,
+		Outputs: []*externalapi.DomainTransactionOutput{
+			{Value: 100, ScriptPublicKey: blueScript},       // merged blue block
+			{Value: 50, ScriptPublicKey: placeholderScript}, // merged red blocks
+		},
+		SubnetworkID: subnetworks.SubnetworkIDCoinbase,
+		Payload:      payload,
+	}
+	templateTxs := []*externalapi.DomainTransaction{coinbase, testTransaction(1), testTransaction(2)}
+	rpcTxs := make([]*appmessage.RPCTransaction, len(templateTxs))
+	for i, tx := range templateTxs {
+		rpcTxs[i] = appmessage.DomainTransactionToRPCTransaction(tx)
+	}
+	template := &appmessage.GetBlockTemplateResponseMessage{
+		Block: &appmessage.RPCBlock{
+			Header: &appmessage.RPCBlockHeader{
+				HashMerkleRoot: merkle.CalculateHashMerkleRoot(templateTxs).String(),
+				BlueScore:      1234,
+			},
+			Transactions: rpcTxs,
+		},
+		IsSynced: true,
+	}
+
+	fetches := 0
+	fetch := func(address string) (*appmessage.GetBlockTemplateResponseMessage, error) {
+		fetches++
+		if address != placeholder.EncodeAddress() {
+			t.Fatalf("template fetched for %s rather than the placeholder", address)
+		}
+		return template, nil
+	}
+	built, err := builder.Build(walletAddr.EncodeAddress(), "worker rig1", fetch)
+	if err != nil {
+		t.Fatalf("failed building block: %s", err)
+	}
+
+	builtCoinbase, err := appmessage.RPCTransactionToDomainTransaction(built.Block.Transactions[0])
+	if err != nil {
+		t.Fatalf("failed decoding built coinbase: %s", err)
+	}
+	expectedPayload, _ := coinbasemanager.ModifyCoinbasePayload(append([]byte{}, payload...), &externalapi.DomainCoinbaseData{
+		ScriptPublicKey: walletScript, ExtraData: []byte("worker rig1"),
+	}, coinbaseScriptPublicKeyMaxLength)
+	if string(builtCoinbase.Payload) != string(expectedPayload) {
+		t.Errorf("coinbase payload not rewritten for the wallet")
+	}
+	if !builtCoinbase.Outputs[0].ScriptPublicKey.Equal(blueScript) {
+		t.Errorf("blue block reward output changed")
+	}
+	if !builtCoinbase.Outputs[1].ScriptPublicKey.Equal(walletScript) {
+		t.Errorf("red block reward not paid to the wallet")
+	}
+
+	builtTxs := []*externalapi.DomainTransaction{builtCoinbase, testTransaction(1), testTransaction(2)}
+	if expected := merkle.CalculateHashMerkleRoot(builtTxs).String(); built.Block.Header.HashMerkleRoot != expected {
+		t.Errorf("expected merkle root %s, got %s", expected, built.Block.Header.HashMerkleRoot)
+	}
+
+	// the shared template is left alone for the next miner
+	if template.Block.Transactions[0] != rpcTxs[0] || template.Block.Header.HashMerkleRoot != merkle.CalculateHashMerkleRoot(templateTxs).String() {
+		t.Errorf("shared template modified")
+	}
+	if _, err := builder.Build(walletAddr.EncodeAddress(), "worker rig2", fetch); err != nil || fetches != 2 {
+		t.Errorf("second build failed: %v", err)
+	}
+	if builder.current.source != template {
+		t.Errorf("template not reused")
+	}
+
+	if _, err := builder.Build("hoosat:notanaddress", "worker", fetch); err == nil {
+		t.Errorf("expected bad wallet to be rejected")
+	}
+}
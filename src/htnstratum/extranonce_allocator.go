@@ -0,0 +1,250 @@
+package htnstratum
+
+import (
+	"fmt"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+const defaultExtranoncePinTTL = 10 * time.Minute
+const extranonceSweepInterval = time.Minute
+
+var ErrExtranonceExhausted = fmt.Errorf("no free extranonce available")
+
+// extranoncePin holds an extranonce for a reconnecting miner, keyed by its
+// wallet.worker identity and/or its session id
+type extranoncePin struct {
+	value   uint32
+	owner   int32         // client currently holding the value, 0 if reserved
+	ttl     time.Duration // how long the value is held once the owner leaves
+	expires time.Time     // when a reserved value is given back to the pool
+	keys    []string
+}
+
+// extranonceAllocator hands out the lowest free extranonce and takes them
+// back when clients disconnect, so live clients never share nonce space
+// unless the space is actually exhausted. A nil allocator (extranonces
+// disabled) hands out nothing
+type extranonceAllocator struct {
+	lock      sync.Mutex
+	size      int8
+	capacity  uint32
+	used      []uint64 // bitmap of allocated and reserved values
+	inUse     uint32
+	reserved  uint32 // pinned values waiting for their holder to come back
+	hint      uint32 // no free value exists below this
+	clients   map[int32]uint32
+	pinTTL    time.Duration // 0 disables pinning to wallet.worker
+	pins      map[string]*extranoncePin
+	held      map[int32]*extranoncePin
+	lastSweep time.Time
+	clock     func() time.Time
+}
+
+func newExtranonceAllocator(size int8, pinTTL time.Duration) *extranonceAllocator {
+	if size > 3 {
+		size = 3
+	}
+	capacity := uint32(1) << (8 * uint(size))
+	return &extranonceAllocator{
+		size:     size,
+		capacity: capacity,
+		used:     make([]uint64, (capacity+63)/64),
+		clients:  map[int32]uint32{},
+		pinTTL:   pinTTL,
+		pins:     map[string]*extranoncePin{},
+		held:     map[int32]*extranoncePin{},
+		clock:    time.Now,
+	}
+}
+
+func (a *extranonceAllocator) format(value uint32) string {
+	return fmt.Sprintf("%0*x", a.size*2, value)
+}
+
+func (a *extranonceAllocator) set(value uint32) {
+	a.used[value/64] |= 1 << (value % 64)
+	a.inUse++
+}
+
+func (a *extranonceAllocator) clear(value uint32) {
+	a.used[value/64] &^= 1 << (value % 64)
+	a.inUse--
+	if value < a.hint {
+		a.hint = value
+	}
+}
+
+func (a *extranonceAllocator) lowestFree() (uint32, bool) {
+	for word := a.hint / 64; word < uint32(len(a.used)); word++ {
+		if a.used[word] == ^uint64(0) {
+			continue
+		}
+		value := word*64 + uint32(bits.TrailingZeros64(^a.used[word]))
+		if value >= a.capacity {
+			break
+		}
+		a.hint = value
+		return value, true
+	}
+	a.hint = a.capacity
+	return 0, false
+}
+
+// expirePins gives reserved values whose holders haven't come back within the
+// ttl back to the pool
+func (a *extranonceAllocator) expirePins() {
+	now := a.clock()
+	a.lastSweep = now
+	for _, pin := range a.pins {
+		if pin.owner == 0 && now.After(pin.expires) {
+			for _, key := range pin.keys {
+				delete(a.pins, key)
+			}
+			a.reserved--
+			a.clear(pin.value)
+		}
+	}
+}
+
+// Allocate assigns the lowest free extranonce to the client
+func (a *extranonceAllocator) Allocate(clientId int32) (string, error) {
+	if a == nil {
+		return "", nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.reserved > 0 && a.clock().Sub(a.lastSweep) > extranonceSweepInterval {
+		a.expirePins()
+	}
+	value, ok := a.lowestFree()
+	if !ok && a.reserved > 0 {
+		a.expirePins()
+		value, ok = a.lowestFree()
+	}
+	if !ok {
+		RecordExtranonceExhausted()
+		return "", ErrExtranonceExhausted
+	}
+	a.set(value)
+	a.clients[clientId] = value
+	a.recordStats()
+	return a.format(value), nil
+}
+
+// Pin ties the client's extranonce to its wallet.worker identity
+func (a *extranonceAllocator) Pin(clientId int32, identity string) (string, bool) {
+	if a == nil || a.pinTTL <= 0 {
+		return "", false
+	}
+	return a.pin(clientId, "worker:"+identity, a.pinTTL)
+}
+
+// PinSession holds the client's extranonce for a resumable session
+func (a *extranonceAllocator) PinSession(clientId int32, sessionId string, grace time.Duration) (string, bool) {
+	if a == nil {
+		return "", false
+	}
+	return a.pin(clientId, "session:"+sessionId, grace)
+}
+
+// pin ties the client's extranonce to the key. If the key already has a
+// reserved value from an earlier connection the client is moved onto it, in
+// which case the new extranonce is returned along with true
+func (a *extranonceAllocator) pin(clientId int32, key string, ttl time.Duration) (string, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	current, exists := a.clients[clientId]
+	if !exists {
+		return "", false
+	}
+	held := a.held[clientId]
+	pin, pinned := a.pins[key]
+	switch {
+	case !pinned && held != nil:
+		// already held under another key, hold it under this one too
+		held.keys = append(held.keys, key)
+		if ttl > held.ttl {
+			held.ttl = ttl
+		}
+		a.pins[key] = held
+		return a.format(current), false
+	case !pinned:
+		pin = &extranoncePin{value: current, owner: clientId, ttl: ttl, keys: []string{key}}
+		a.pins[key] = pin
+		a.held[clientId] = pin
+		return a.format(current), false
+	case pin.owner != 0:
+		// either already ours, or the same worker connected twice in which
+		// case the second one can't share the space
+		return a.format(current), false
+	}
+	if held != nil {
+		for _, k := range held.keys {
+			delete(a.pins, k)
+		}
+	}
+	a.clear(current)
+	a.reserved--
+	pin.owner = clientId
+	a.clients[clientId] = pin.value
+	a.held[clientId] = pin
+	a.recordStats()
+	return a.format(pin.value), true
+}
+
+// UnpinSession stops holding the client's extranonce for a session it no
+// longer has
+func (a *extranonceAllocator) UnpinSession(clientId int32, sessionId string) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	key := "session:" + sessionId
+	pin := a.held[clientId]
+	if pin == nil || a.pins[key] != pin {
+		return
+	}
+	delete(a.pins, key)
+	kept := pin.keys[:0]
+	for _, k := range pin.keys {
+		if k != key {
+			kept = append(kept, k)
+		}
+	}
+	pin.keys = kept
+	if len(kept) == 0 {
+		delete(a.held, clientId)
+	}
+}
+
+// Release returns the client's extranonce to the pool, or reserves it for
+// the pin's ttl if it's pinned
+func (a *extranonceAllocator) Release(clientId int32) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	value, exists := a.clients[clientId]
+	if !exists {
+		return
+	}
+	delete(a.clients, clientId)
+	if pin := a.held[clientId]; pin != nil {
+		delete(a.held, clientId)
+		pin.owner = 0
+		pin.expires = a.clock().Add(pin.ttl)
+		a.reserved++
+		a.recordStats()
+		return
+	}
+	a.clear(value)
+	a.recordStats()
+}
+
+func (a *extranonceAllocator) recordStats() {
+	RecordExtranonceStats(a.size, a.inUse-a.reserved, a.reserved, a.capacity)
+}
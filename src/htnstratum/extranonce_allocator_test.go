@@ -0,0 +1,62 @@
+package htnstratum
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestExtranonceAllocator(t *testing.T) {
+	now := time.Now()
+	a := newExtranonceAllocator(1, time.Minute)
+	a.clock = func() time.Time { return now }
+
+	for i := int32(1); i <= 256; i++ {
+		if _, err := a.Allocate(i); err != nil {
+			t.Fatalf("allocation %d failed: %s", i, err)
+		}
+	}
+	if _, err := a.Allocate(257); !errors.Is(err, ErrExtranonceExhausted) {
+		t.Fatalf("expected exhaustion, got %v", err)
+	}
+
+	// freed values are reused lowest first
+	a.Release(11)
+	a.Release(4)
+	if en, _ := a.Allocate(258); en != "03" {
+		t.Fatalf("expected lowest free extranonce 03, got %s", en)
+	}
+	if en, _ := a.Allocate(259); en != "0a" {
+		t.Fatalf("expected extranonce 0a, got %s", en)
+	}
+
+	// a pinned worker gets its extranonce back after reconnecting
+	a.Pin(100, "wallet.rig1") // holds 63
+	a.Release(100)
+	a.Release(1) // frees 00
+	if en, _ := a.Allocate(300); en != "00" {
+		t.Fatalf("expected 00, reserved extranonce handed out instead: %s", en)
+	}
+	a.Release(300)
+	a.Allocate(301)
+	if en, moved := a.Pin(301, "wallet.rig1"); !moved || en != "63" {
+		t.Fatalf("expected pinned extranonce 63 restored, got %s (moved %t)", en, moved)
+	}
+	// 00 went back to the pool when 301 moved onto its pinned value
+	if a.reserved != 0 || a.inUse != 255 {
+		t.Fatalf("unexpected accounting, reserved %d in use %d", a.reserved, a.inUse)
+	}
+
+	// reservations expire if the worker doesn't come back
+	a.Release(301)
+	if en, err := a.Allocate(302); err != nil || en != "00" {
+		t.Fatalf("expected extranonce 00, got %s %v", en, err)
+	}
+	if _, err := a.Allocate(303); !errors.Is(err, ErrExtranonceExhausted) {
+		t.Fatalf("expected reserved extranonce to be held, got %v", err)
+	}
+	now = now.Add(2 * time.Minute)
+	if en, err := a.Allocate(304); err != nil || en != "63" {
+		t.Fatalf("expected expired reservation 63 to be reused, got %s %v", en, err)
+	}
+}
@@ -17,9 +17,13 @@ import (
 type HtnApi struct {
 	address       string
 	blockWaitTime time.Duration
+	notifier      *blockNotifier
+	tip           *chainTip
 	logger        *zap.SugaredLogger
 	hoosat        *rpcclient.RPCClient
 	connected     bool
+	templates     *templateCache
+	coinbase      *coinbaseBuilder // builds every miner's block from one template, nil to fetch per miner
 }
 
 func NewHoosatAPI(address string, blockWaitTime time.Duration, logger *zap.SugaredLogger) (*HtnApi, error) {
@@ -28,19 +32,24 @@ func NewHoosatAPI(address string, blockWaitTime time.Duration, logger *zap.Sugar
 		return nil, err
 	}
 
-	return &HtnApi{
+	htnApi := &HtnApi{
 		address:       address,
 		blockWaitTime: blockWaitTime,
 		logger:        logger.With(zap.String("component", "hoosatapi:"+address)),
 		hoosat:        client,
 		connected:     true,
-	}, nil
+		notifier:      newBlockNotifier(defaultNotificationTimeout),
+		tip:           newChainTip(),
+	}
+	htnApi.templates = newTemplateCache(defaultTemplateCacheTTL, htnApi.fetchBlockTemplate)
+	return htnApi, nil
 }
 
-func (htnApi *HtnApi) Start(ctx context.Context, cfg BridgeConfig, blockCb func()) {
+func (htnApi *HtnApi) Start(ctx context.Context, cfg BridgeConfig, blockCb func(notified time.Time)) {
 	if !cfg.MineWhenNotSynced {
 		htnApi.waitForSync(true)
 	}
+	htnApi.startChainTipListener()
 	go htnApi.startBlockTemplateListener(ctx, blockCb)
 	go htnApi.startStatsThread(ctx)
 }
@@ -102,13 +111,36 @@ func (htnApi *HtnApi) waitForSync(verbose bool) error {
 	return nil
 }
 
-func (htnApi *HtnApi) startBlockTemplateListener(ctx context.Context, blockReadyCb func()) {
-	blockReadyChan := make(chan bool)
+// startChainTipListener follows the node's blue score, which shares are
+// checked against for staleness
+func (htnApi *HtnApi) startChainTipListener() {
+	err := htnApi.hoosat.RegisterForVirtualSelectedParentBlueScoreChangedNotifications(
+		func(notification *appmessage.VirtualSelectedParentBlueScoreChangedNotificationMessage) {
+			htnApi.tip.Update(notification.VirtualSelectedParentBlueScore)
+		})
+	if err != nil {
+		htnApi.logger.Error("failed to register for blue score notifications from hoosat, stale shares won't be detected", zap.Error(err))
+	}
+	response, err := htnApi.hoosat.GetVirtualSelectedParentBlueScore()
+	if err != nil {
+		htnApi.logger.Warn("failed to get the blue score from hoosat, waiting for the next notification", zap.Error(err))
+		return
+	}
+	htnApi.tip.Update(response.BlueScore)
+}
+
+// startBlockTemplateListener hands new templates to blockReadyCb along with
+// when the node announced them. The template is polled every blockWaitTime
+// only while notifications are silent
+func (htnApi *HtnApi) startBlockTemplateListener(ctx context.Context, blockReadyCb func(notified time.Time)) {
+	notifier := htnApi.notifier
+	RecordTemplateMode(false)
 	err := htnApi.hoosat.RegisterForNewBlockTemplateNotifications(func(_ *appmessage.NewBlockTemplateNotificationMessage) {
-		blockReadyChan <- true
+		notifier.Notify()
 	})
 	if err != nil {
-		htnApi.logger.Error("fatal: failed to register for block notifications from hoosat")
+		htnApi.logger.Error("failed to register for block notifications from hoosat, polling for templates")
+		notifier.SetPolling(true)
 	}
 
 	ticker := time.NewTicker(htnApi.blockWaitTime)
@@ -124,11 +156,25 @@ func (htnApi *HtnApi) startBlockTemplateListener(ctx context.Context, blockReady
 		case <-ctx.Done():
 			htnApi.logger.Warn("context cancelled, stopping block update listener")
 			return
-		case <-blockReadyChan:
-			blockReadyCb()
-			ticker.Reset(htnApi.blockWaitTime)
-		case <-ticker.C: // timeout, manually check for new blocks
-			blockReadyCb()
+		case <-notifier.ready:
+			notified := notifier.Take()
+			if notifier.SetPolling(false) {
+				htnApi.logger.Info("block template notifications resumed, stopped polling")
+			}
+			RecordTemplateEvent(templateEventNotification, time.Since(notified))
+			htnApi.templates.NewEvent()
+			blockReadyCb(notified)
+		case <-ticker.C:
+			if !notifier.Silent() {
+				continue
+			}
+			if notifier.SetPolling(true) {
+				htnApi.logger.Warn(fmt.Sprintf("no block template notifications for %s, polling every %s",
+					notifier.timeout, htnApi.blockWaitTime))
+			}
+			RecordTemplateEvent(templateEventPoll, 0)
+			htnApi.templates.NewEvent()
+			blockReadyCb(time.Now())
 		}
 	}
 }
@@ -147,21 +193,40 @@ func sanitizeWorkerID(s string) string {
 	return s
 }
 
-func (htnApi *HtnApi) GetBlockTemplate(client *gostratum.StratumContext, poll int64, vote int64) (*appmessage.GetBlockTemplateResponseMessage, error) {
+// templatePayload is the coinbase extra data identifying the miner
+func templatePayload(client *gostratum.StratumContext, poll int64, vote int64) string {
 	if poll != 0 && vote != 0 {
-		template, err := htnApi.hoosat.GetBlockTemplate(client.WalletAddr,
-			fmt.Sprintf(`'%s' via htn-stratum-bridge_%s as worker %s poll %d vote %d `, client.RemoteApp, version, sanitizeWorkerID(client.WorkerName), poll, vote))
-		if err != nil {
-			return nil, errors.Wrap(err, "failed fetching new block template from hoosat")
-		}
-		return template, nil
-	} else {
-		template, err := htnApi.hoosat.GetBlockTemplate(client.WalletAddr,
-			fmt.Sprintf(`'%s' via htn-stratum-bridge_%s as worker %s`, client.RemoteApp, version, sanitizeWorkerID(client.WorkerName)))
-		if err != nil {
-			return nil, errors.Wrap(err, "failed fetching new block template from hoosat")
-		}
-		return template, nil
+		return fmt.Sprintf(`'%s' via htn-stratum-bridge_%s as worker %s poll %d vote %d `, client.RemoteApp, version, sanitizeWorkerID(client.WorkerName), poll, vote)
+	}
+	return fmt.Sprintf(`'%s' via htn-stratum-bridge_%s as worker %s`, client.RemoteApp, version, sanitizeWorkerID(client.WorkerName))
+}
+
+// lookupBlock fetches a block's verbose data, without its transactions
+func (htnApi *HtnApi) lookupBlock(hash string) (*appmessage.RPCBlock, error) {
+	response, err := htnApi.hoosat.GetBlock(hash, false)
+	if err != nil {
+		return nil, err
 	}
+	return response.Block, nil
+}
 
+func (htnApi *HtnApi) fetchBlockTemplate(wallet string, payload string) (*appmessage.GetBlockTemplateResponseMessage, error) {
+	template, err := htnApi.hoosat.GetBlockTemplate(wallet, payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed fetching new block template from hoosat")
+	}
+	return template, nil
+}
+
+// GetBlockTemplate returns the client's template, shared with every other
+// client mining to the same wallet with the same payload in this block. With
+// local coinbases every client's template comes from the same fetch
+func (htnApi *HtnApi) GetBlockTemplate(client *gostratum.StratumContext, poll int64, vote int64) (*appmessage.GetBlockTemplateResponseMessage, error) {
+	payload := templatePayload(client, poll, vote)
+	if htnApi.coinbase != nil {
+		return htnApi.coinbase.Build(client.WalletAddr, payload, func(placeholder string) (*appmessage.GetBlockTemplateResponseMessage, error) {
+			return htnApi.templates.Get(placeholder, "htn-stratum-bridge_"+version)
+		})
+	}
+	return htnApi.templates.Get(client.WalletAddr, payload)
 }
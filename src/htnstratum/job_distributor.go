@@ -0,0 +1,111 @@
+package htnstratum
+
+import (
+	"sync"
+
+	"github.com/Hoosat-Oy/htn-stratum-bridge/src/gostratum"
+)
+
+const defaultJobWorkers = 32
+
+// clientJobs is a client's slot in the distributor, at most one job runs
+// for it at a time and only the newest waiting job is kept
+type clientJobs struct {
+	running bool
+	next    func() // newest job not yet started, nil if none
+}
+
+// jobDistributor sends new jobs to clients from a fixed number of workers.
+// Jobs for the same client run one after the other, a job scheduled while
+// the previous one is still waiting replaces it, so a slow client skips
+// straight to the newest block rather than falling behind
+type jobDistributor struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	workers int
+	start   sync.Once
+	clients map[*gostratum.StratumContext]*clientJobs
+	queue   []*gostratum.StratumContext // clients with a job waiting and none running
+}
+
+func newJobDistributor(workers int) *jobDistributor {
+	if workers <= 0 {
+		workers = defaultJobWorkers
+	}
+	jd := &jobDistributor{
+		workers: workers,
+		clients: map[*gostratum.StratumContext]*clientJobs{},
+	}
+	jd.cond = sync.NewCond(&jd.lock)
+	return jd
+}
+
+// Schedule queues the job for the client, replacing any of its jobs that
+// haven't started yet
+func (jd *jobDistributor) Schedule(client *gostratum.StratumContext, job func()) {
+	jd.start.Do(func() {
+		for i := 0; i < jd.workers; i++ {
+			go jd.work()
+		}
+	})
+	jd.lock.Lock()
+	defer jd.lock.Unlock()
+	slot, exists := jd.clients[client]
+	if !exists {
+		slot = &clientJobs{}
+		jd.clients[client] = slot
+	}
+	if slot.next != nil {
+		RecordJobCoalesced()
+		slot.next = job
+		return
+	}
+	slot.next = job
+	if !slot.running {
+		jd.queue = append(jd.queue, client)
+		jd.cond.Signal()
+	}
+	RecordJobQueueDepth(len(jd.queue))
+}
+
+// Remove forgets the client once it's gone
+func (jd *jobDistributor) Remove(client *gostratum.StratumContext) {
+	jd.lock.Lock()
+	defer jd.lock.Unlock()
+	if slot, exists := jd.clients[client]; exists {
+		// a running job finds the slot gone and doesn't requeue
+		slot.next = nil
+		delete(jd.clients, client)
+	}
+}
+
+func (jd *jobDistributor) work() {
+	jd.lock.Lock()
+	for {
+		for len(jd.queue) == 0 {
+			jd.cond.Wait()
+		}
+		client := jd.queue[0]
+		jd.queue[0] = nil
+		jd.queue = jd.queue[1:]
+		RecordJobQueueDepth(len(jd.queue))
+		slot, exists := jd.clients[client]
+		if !exists || slot.next == nil {
+			continue
+		}
+		job := slot.next
+		slot.next = nil
+		slot.running = true
+		jd.lock.Unlock()
+
+		job()
+
+		jd.lock.Lock()
+		slot.running = false
+		if slot.next != nil && jd.clients[client] == slot {
+			// a newer block came in while this one was being sent
+			jd.queue = append(jd.queue, client)
+			jd.cond.Signal()
+		}
+	}
+}
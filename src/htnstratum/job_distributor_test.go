@@ -0,0 +1,112 @@
+package htnstratum
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Hoosat-Oy/htn-stratum-bridge/src/gostratum"
+	"go.uber.org/zap"
+)
+
+func TestJobDistributor(t *testing.T) {
+	jd := newJobDistributor(2)
+	client, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+
+	// jobs for one client run in order, one at a time, and the ones
+	// superseded while waiting are skipped
+	lock := sync.Mutex{}
+	var sent []int
+	running := 0
+	release := make(chan struct{})
+	done := make(chan struct{}, 10)
+	job := func(n int) func() {
+		return func() {
+			lock.Lock()
+			running++
+			if running > 1 {
+				t.Errorf("jobs for the same client ran concurrently")
+			}
+			lock.Unlock()
+			if n == 1 {
+				<-release
+			}
+			lock.Lock()
+			running--
+			sent = append(sent, n)
+			lock.Unlock()
+			done <- struct{}{}
+		}
+	}
+	jd.Schedule(client, job(1))
+	for {
+		lock.Lock()
+		started := running == 1
+		lock.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for n := 2; n <= 5; n++ {
+		jd.Schedule(client, job(n))
+	}
+	close(release)
+	<-done
+	<-done
+	select {
+	case <-done:
+		t.Fatalf("superseded job was sent")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if len(sent) != 2 || sent[0] != 1 || sent[1] != 5 {
+		t.Fatalf("expected jobs 1 then 5, got %v", sent)
+	}
+
+	// no more than the configured workers run at once
+	block := make(chan struct{})
+	concurrent, peak := 0, 0
+	finished := sync.WaitGroup{}
+	for i := 0; i < 6; i++ {
+		other, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+		finished.Add(1)
+		jd.Schedule(other, func() {
+			lock.Lock()
+			concurrent++
+			if concurrent > peak {
+				peak = concurrent
+			}
+			lock.Unlock()
+			<-block
+			lock.Lock()
+			concurrent--
+			lock.Unlock()
+			finished.Done()
+		})
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(block)
+	finished.Wait()
+	if peak != 2 {
+		t.Fatalf("expected 2 jobs at once, got %d", peak)
+	}
+
+	// a job waiting for a removed client is dropped
+	stall := make(chan struct{})
+	jd.Schedule(client, func() { <-stall })
+	time.Sleep(10 * time.Millisecond)
+	jd.Schedule(client, job(6))
+	jd.Remove(client)
+	close(stall)
+	select {
+	case <-done:
+		t.Fatalf("job sent to a removed client")
+	case <-time.After(50 * time.Millisecond):
+	}
+	jd.lock.Lock()
+	defer jd.lock.Unlock()
+	if _, exists := jd.clients[client]; exists {
+		t.Errorf("removed client still tracked")
+	}
+}
@@ -0,0 +1,234 @@
+package htnstratum
+
+import (
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/Hoosat-Oy/htn-stratum-bridge/src/gostratum"
+	"github.com/pkg/errors"
+)
+
+type JobEncoding string
+
+const (
+	// four little endian header words followed by the timestamp
+	JobEncodingHeader JobEncoding = "header"
+	// single 80 character hex string of header words and timestamp, as
+	// expected by BzMiner
+	JobEncodingLarge JobEncoding = "large"
+)
+
+type NonceEncoding string
+
+const (
+	NonceEncodingHex   NonceEncoding = "hex"    // big endian hex
+	NonceEncodingHexLE NonceEncoding = "hex_le" // little endian byte order hex
+)
+
+type ExtranonceMode string
+
+const (
+	// the miner is given an extranonce and works the remaining nonce space
+	ExtranonceModePrefix ExtranonceMode = "prefix"
+	// the miner gets no extranonce and uses the full nonce
+	ExtranonceModeNone ExtranonceMode = "none"
+)
+
+type DiffStyle string
+
+const (
+	DiffStyleDifficulty DiffStyle = "set_difficulty" // mining.set_difficulty [diff]
+	DiffStyleTarget     DiffStyle = "set_target"     // mining.set_target [hex target]
+)
+
+type Quirk string
+
+const (
+	// resend the difficulty ahead of every job, for miners that lose track
+	// of it between jobs
+	QuirkResendDiff Quirk = "resend_diff"
+	// never send client.show_message, some miners treat unknown methods as
+	// fatal
+	QuirkNoShowMessage Quirk = "no_show_message"
+)
+
+// MinerProfile describes how to talk to a particular miner software, matched
+// on the user agent the miner sends with mining.subscribe
+type MinerProfile struct {
+	Name           string         `yaml:"name"`
+	Match          string         `yaml:"match"` // regex against the user agent
+	JobEncoding    JobEncoding    `yaml:"job_encoding"`
+	NonceEncoding  NonceEncoding  `yaml:"nonce_encoding"`
+	ExtranonceMode ExtranonceMode `yaml:"extranonce_mode"`
+	DiffStyle      DiffStyle      `yaml:"diff_style"`
+	Quirks         []Quirk        `yaml:"quirks"`
+	// accept nonces outside the assigned extranonce, for miners that are
+	// given one but search the full nonce anyway
+	NoExtranonceCheck bool `yaml:"no_extranonce_check"`
+
+	matcher *regexp.Regexp
+}
+
+var builtinProfiles = []MinerProfile{
+	{Name: "bzminer", Match: ".*BzMiner.*", JobEncoding: JobEncodingLarge},
+}
+
+var defaultProfile = func() *MinerProfile {
+	p := &MinerProfile{Name: "default"}
+	p.init()
+	return p
+}()
+
+func (p *MinerProfile) init() error {
+	if p.JobEncoding == "" {
+		p.JobEncoding = JobEncodingHeader
+	}
+	if p.NonceEncoding == "" {
+		p.NonceEncoding = NonceEncodingHex
+	}
+	if p.ExtranonceMode == "" {
+		p.ExtranonceMode = ExtranonceModePrefix
+	}
+	if p.DiffStyle == "" {
+		p.DiffStyle = DiffStyleDifficulty
+	}
+	switch p.JobEncoding {
+	case JobEncodingHeader, JobEncodingLarge:
+	default:
+		return fmt.Errorf("profile %s: unknown job_encoding %q", p.Name, p.JobEncoding)
+	}
+	switch p.NonceEncoding {
+	case NonceEncodingHex, NonceEncodingHexLE:
+	default:
+		return fmt.Errorf("profile %s: unknown nonce_encoding %q", p.Name, p.NonceEncoding)
+	}
+	switch p.ExtranonceMode {
+	case ExtranonceModePrefix, ExtranonceModeNone:
+	default:
+		return fmt.Errorf("profile %s: unknown extranonce_mode %q", p.Name, p.ExtranonceMode)
+	}
+	switch p.DiffStyle {
+	case DiffStyleDifficulty, DiffStyleTarget:
+	default:
+		return fmt.Errorf("profile %s: unknown diff_style %q", p.Name, p.DiffStyle)
+	}
+	for _, q := range p.Quirks {
+		switch q {
+		case QuirkResendDiff, QuirkNoShowMessage:
+		default:
+			return fmt.Errorf("profile %s: unknown quirk %q", p.Name, q)
+		}
+	}
+	if p.Match != "" {
+		matcher, err := regexp.Compile(p.Match)
+		if err != nil {
+			return errors.Wrapf(err, "profile %s: invalid match", p.Name)
+		}
+		p.matcher = matcher
+	}
+	return nil
+}
+
+func (p *MinerProfile) HasQuirk(quirk Quirk) bool {
+	for _, q := range p.Quirks {
+		if q == quirk {
+			return true
+		}
+	}
+	return false
+}
+
+// jobParams builds the mining.notify params for the job
+func (p *MinerProfile) jobParams(jobId int, header []byte, timestamp int64) []any {
+	params := []any{fmt.Sprintf("%d", jobId)}
+	if p.JobEncoding == JobEncodingLarge {
+		return append(params, GenerateLargeJobParams(header, uint64(timestamp)))
+	}
+	return append(params, GenerateJobHeader(header), timestamp)
+}
+
+// parseNonce decodes the nonce from a mining.submit, any 0x prefix has already
+// been removed
+func (p *MinerProfile) parseNonce(noncestr string) (uint64, error) {
+	nonce, err := strconv.ParseUint(noncestr, 16, 64)
+	if err != nil {
+		return 0, err
+	}
+	if p.NonceEncoding == NonceEncodingHexLE {
+		var raw [8]byte
+		binary.BigEndian.PutUint64(raw[:], nonce)
+		nonce = binary.LittleEndian.Uint64(raw[:])
+	}
+	return nonce, nil
+}
+
+// diffEvent builds the message telling the miner about a new difficulty
+func (p *MinerProfile) diffEvent(diff *hoosatDiff) gostratum.JsonRpcEvent {
+	if p.DiffStyle == DiffStyleTarget {
+		return gostratum.JsonRpcEvent{
+			Version: "2.0",
+			Method:  "mining.set_target",
+			Params:  []any{fmt.Sprintf("%064x", diff.targetValue)},
+		}
+	}
+	return gostratum.JsonRpcEvent{
+		Version: "2.0",
+		Method:  "mining.set_difficulty",
+		Params:  []any{diff.diffValue},
+	}
+}
+
+// minerProfiles matches miners to profiles, configured profiles are checked
+// in order ahead of the builtin ones
+type minerProfiles struct {
+	profiles []*MinerProfile
+	fallback *MinerProfile
+}
+
+func newMinerProfiles(configured []MinerProfile) (*minerProfiles, error) {
+	registry := &minerProfiles{}
+	for _, p := range append(append([]MinerProfile{}, configured...), builtinProfiles...) {
+		profile := p
+		if profile.Match == "" {
+			return nil, fmt.Errorf("profile %s: match is required", profile.Name)
+		}
+		if err := profile.init(); err != nil {
+			return nil, err
+		}
+		registry.profiles = append(registry.profiles, &profile)
+	}
+	registry.fallback = defaultProfile
+	return registry, nil
+}
+
+// Match returns the profile for the user agent, falling back to the default
+func (r *minerProfiles) Match(userAgent string) *MinerProfile {
+	if r == nil {
+		return defaultProfile
+	}
+	for _, p := range r.profiles {
+		if p.matcher.MatchString(userAgent) {
+			return p
+		}
+	}
+	return r.fallback
+}
+
+// ByName looks up a profile for ports that force one regardless of the user
+// agent
+func (r *minerProfiles) ByName(name string) (*MinerProfile, bool) {
+	if name == defaultProfile.Name {
+		return defaultProfile, true
+	}
+	if r == nil {
+		return nil, false
+	}
+	for _, p := range r.profiles {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return nil, false
+}
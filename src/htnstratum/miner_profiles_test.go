@@ -0,0 +1,88 @@
+package htnstratum
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMinerProfiles(t *testing.T) {
+	profiles, err := newMinerProfiles([]MinerProfile{
+		{Name: "custom", Match: "^CustomMiner/", NonceEncoding: NonceEncodingHexLE,
+			DiffStyle: DiffStyleTarget, ExtranonceMode: ExtranonceModeNone,
+			Quirks: []Quirk{QuirkResendDiff}},
+	})
+	if err != nil {
+		t.Fatalf("failed loading profiles: %s", err)
+	}
+
+	header := make([]byte, 32)
+	for i := range header {
+		header[i] = byte(i)
+	}
+	diff := newHoosatDiff()
+	diff.setDiffValue(4)
+
+	tests := []struct {
+		userAgent string
+		profile   string
+		job       []any
+		nonce     uint64
+		diff      []any
+	}{
+		{
+			userAgent: "BzMiner-v21.5.3",
+			profile:   "bzminer",
+			job:       []any{"7", "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f0068e5cf8b010000"},
+			nonce:     0x0102030405060708,
+			diff:      []any{4.0},
+		},
+		{
+			userAgent: "HoosatMiner/0.2.1",
+			profile:   "default",
+			job: []any{"7", []uint64{0x0706050403020100, 0x0f0e0d0c0b0a0908, 0x1716151413121110, 0x1f1e1d1c1b1a1918},
+				int64(1700000000000)},
+			nonce: 0x0102030405060708,
+			diff:  []any{4.0},
+		},
+		{
+			userAgent: "CustomMiner/1.0",
+			profile:   "custom",
+			job: []any{"7", []uint64{0x0706050403020100, 0x0f0e0d0c0b0a0908, 0x1716151413121110, 0x1f1e1d1c1b1a1918},
+				int64(1700000000000)},
+			nonce: 0x0807060504030201,
+			diff:  []any{"0000000040000000000000000000000000000000000000000000000000000000"},
+		},
+	}
+	for _, tc := range tests {
+		profile := profiles.Match(tc.userAgent)
+		if profile.Name != tc.profile {
+			t.Fatalf("%s: expected profile %s, got %s", tc.userAgent, tc.profile, profile.Name)
+		}
+		if d := cmp.Diff(tc.job, profile.jobParams(7, header, 1700000000000)); d != "" {
+			t.Errorf("%s: job params mismatch: %s", tc.userAgent, d)
+		}
+		nonce, err := profile.parseNonce("0102030405060708")
+		if err != nil {
+			t.Fatalf("%s: failed parsing nonce: %s", tc.userAgent, err)
+		}
+		if nonce != tc.nonce {
+			t.Errorf("%s: expected nonce %x, got %x", tc.userAgent, tc.nonce, nonce)
+		}
+		if d := cmp.Diff(tc.diff, profile.diffEvent(diff).Params); d != "" {
+			t.Errorf("%s: diff message mismatch: %s", tc.userAgent, d)
+		}
+	}
+
+	custom := profiles.Match("CustomMiner/1.0")
+	if !custom.HasQuirk(QuirkResendDiff) || custom.ExtranonceMode != ExtranonceModeNone {
+		t.Errorf("custom profile settings not applied: %+v", custom)
+	}
+
+	if _, err := newMinerProfiles([]MinerProfile{{Name: "bad", Match: ".*", JobEncoding: "xml"}}); err == nil {
+		t.Errorf("expected unknown job encoding to be rejected")
+	}
+	if _, err := newMinerProfiles([]MinerProfile{{Name: "bad"}}); err == nil {
+		t.Errorf("expected profile without match to be rejected")
+	}
+}
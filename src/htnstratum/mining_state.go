@@ -1,8 +1,10 @@
 package htnstratum
 
 import (
+	"fmt"
 	"math/big"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Hoosat-Oy/HTND/app/appmessage"
@@ -11,22 +13,35 @@ import (
 
 const maxjobs = 32
 
+// miningJob is a block template sent to the miner along with the difficulty
+// in force when it was sent
+type miningJob struct {
+	block *appmessage.RPCBlock
+	diff  *hoosatDiff // nil if sent before the difficulty was set
+}
+
 type MiningState struct {
-	Jobs        map[int]*appmessage.RPCBlock
+	id          uint64 // unique per state, job ids are only unique within one
+	Jobs        map[int]*miningJob
 	JobLock     sync.Mutex
 	jobCounter  int
 	bigDiff     big.Int
 	initialized bool
-	useBigJob   bool
-	connectTime time.Time
+	profile     *MinerProfile
+	port        *stratumPort
 	stratumDiff *hoosatDiff
+	diffChanged time.Time // when stratumDiff last changed
+
+	extranonceViolations int // submits with a nonce outside the assigned extranonce
 }
 
+var miningStateIds atomic.Uint64
+
 func MiningStateGenerator() any {
 	return &MiningState{
-		Jobs:        map[int]*appmessage.RPCBlock{},
-		JobLock:     sync.Mutex{},
-		connectTime: time.Now(),
+		id:      miningStateIds.Add(1),
+		Jobs:    map[int]*miningJob{},
+		JobLock: sync.Mutex{},
 	}
 }
 
@@ -34,22 +49,105 @@ func GetMiningState(ctx *gostratum.StratumContext) *MiningState {
 	return ctx.State.(*MiningState)
 }
 
+// Profile is the miner profile assigned on subscribe, or the default profile
+// for miners that haven't subscribed
+func (ms *MiningState) Profile() *MinerProfile {
+	if ms.profile == nil {
+		return defaultProfile
+	}
+	return ms.profile
+}
+
+// Port is the listener the miner connected to, or the default policy for
+// states created outside a listener
+func (ms *MiningState) Port() *stratumPort {
+	if ms.port == nil {
+		return defaultPort
+	}
+	return ms.port
+}
+
+// AddJob stores the job bound to the current difficulty
 func (ms *MiningState) AddJob(job *appmessage.RPCBlock) int {
 	ms.jobCounter++
 	idx := ms.jobCounter
+	bound := &miningJob{block: job}
+	if ms.stratumDiff != nil {
+		// the difficulty is changed in place, so the job keeps a copy
+		diff := *ms.stratumDiff
+		bound.diff = &diff
+	}
 	ms.JobLock.Lock()
-	ms.Jobs[idx%maxjobs] = job
+	ms.Jobs[idx%maxjobs] = bound
 	ms.JobLock.Unlock()
 	return idx
 }
 
 func (ms *MiningState) GetJob(id int) (*appmessage.RPCBlock, bool) {
+	job, exists := ms.getJob(id)
+	if !exists {
+		return nil, false
+	}
+	return job.block, true
+}
+
+func (ms *MiningState) getJob(id int) (*miningJob, bool) {
 	ms.JobLock.Lock()
 	job, exists := ms.Jobs[id%maxjobs]
 	ms.JobLock.Unlock()
 	return job, exists
 }
 
+// setDiff changes the difficulty for jobs sent from now on
+func (ms *MiningState) setDiff(diff float64) {
+	if ms.stratumDiff == nil {
+		ms.stratumDiff = newHoosatDiff()
+	}
+	ms.stratumDiff.setDiffValue(diff)
+	ms.diffChanged = time.Now()
+}
+
+// diffGrace decides which difficulty shares on a job sent before the latest
+// difficulty change are held to. By default it's the job's own difficulty
+// for as long as the job is valid
+type diffGrace struct {
+	current bool          // always the current difficulty
+	window  time.Duration // only this long after the change, 0 for no limit
+}
+
+// parseDiffGrace reads the share_diff_grace setting: "job" (the default),
+// "current", or how long after a change the job's difficulty is honoured
+func parseDiffGrace(setting string) (diffGrace, error) {
+	switch setting {
+	case "", "job":
+		return diffGrace{}, nil
+	case "current":
+		return diffGrace{current: true}, nil
+	}
+	window, err := time.ParseDuration(setting)
+	if err != nil || window <= 0 {
+		return diffGrace{}, fmt.Errorf("expected job, current or a positive duration, got %q", setting)
+	}
+	return diffGrace{window: window}, nil
+}
+
+// shareDiff is the difficulty a share on the job is validated and credited
+// at, and whether that's a difficulty which has since been superseded. A
+// share only has to meet the lower of the job's and the current difficulty,
+// so one found on an older job after vardiff lowered the difficulty isn't
+// held to the old, higher one
+func (ms *MiningState) shareDiff(job *miningJob, grace diffGrace, now time.Time) (*hoosatDiff, bool) {
+	current := ms.stratumDiff
+	if job == nil || job.diff == nil || grace.current ||
+		(current != nil && job.diff.diffValue >= current.diffValue) {
+		return current, false
+	}
+	if grace.window > 0 && now.Sub(ms.diffChanged) > grace.window {
+		return current, false
+	}
+	return job.diff, current != nil
+}
+
 func (ms *MiningState) RemoveJob(id int) {
 	ms.JobLock.Lock()
 	delete(ms.Jobs, id%maxjobs)
@@ -58,6 +156,6 @@ func (ms *MiningState) RemoveJob(id int) {
 
 func (ms *MiningState) ClearJobs() {
 	ms.JobLock.Lock()
-	ms.Jobs = make(map[int]*appmessage.RPCBlock)
+	ms.Jobs = make(map[int]*miningJob)
 	ms.JobLock.Unlock()
 }
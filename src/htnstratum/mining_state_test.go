@@ -0,0 +1,58 @@
+package htnstratum
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Hoosat-Oy/HTND/app/appmessage"
+)
+
+func TestJobDifficulty(t *testing.T) {
+	state := MiningStateGenerator().(*MiningState)
+	state.setDiff(4)
+	oldId := state.AddJob(&appmessage.RPCBlock{})
+	state.setDiff(16)
+	newId := state.AddJob(&appmessage.RPCBlock{})
+	oldJob, _ := state.getJob(oldId)
+	newJob, _ := state.getJob(newId)
+	if oldJob.diff.diffValue != 4 || newJob.diff.diffValue != 16 {
+		t.Fatalf("jobs not bound to the difficulty they were sent with: %f, %f", oldJob.diff.diffValue, newJob.diff.diffValue)
+	}
+
+	// a job sent before vardiff lowered the difficulty
+	higher := newHoosatDiff()
+	higher.setDiffValue(64)
+	harderJob := &miningJob{diff: higher}
+
+	now := state.diffChanged.Add(5 * time.Second)
+	for _, c := range []struct {
+		name       string
+		setting    string
+		job        *miningJob
+		diff       float64
+		superseded bool
+	}{
+		{"current job", "job", newJob, 16, false},
+		{"superseded job", "job", oldJob, 4, true},
+		{"within grace", "10s", oldJob, 4, true},
+		{"past grace", "2s", oldJob, 16, false},
+		{"current only", "current", oldJob, 16, false},
+		{"unbound job", "job", &miningJob{}, 16, false},
+		{"lowered since the job", "job", harderJob, 16, false},
+	} {
+		grace, err := parseDiffGrace(c.setting)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		diff, superseded := state.shareDiff(c.job, grace, now)
+		if diff.diffValue != c.diff || superseded != c.superseded {
+			t.Errorf("%s: expected diff %f superseded %t, got %f %t", c.name, c.diff, c.superseded, diff.diffValue, superseded)
+		}
+	}
+
+	for _, setting := range []string{"forever", "-1s", "0s"} {
+		if _, err := parseDiffGrace(setting); err == nil {
+			t.Errorf("expected %q to be rejected", setting)
+		}
+	}
+}
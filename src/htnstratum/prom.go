@@ -3,7 +3,9 @@ package htnstratum
 import (
 	"fmt"
 	"net/http"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/Hoosat-Oy/HTND/app/appmessage"
 	"github.com/Hoosat-Oy/htn-stratum-bridge/src/gostratum"
@@ -14,7 +16,7 @@ import (
 )
 
 var workerLabels = []string{
-	"worker", "miner", "wallet", "ip",
+	"worker", "miner", "wallet", "ip", "port",
 }
 
 var shareCounter = promauto.NewCounterVec(prometheus.CounterOpts{
@@ -32,9 +34,19 @@ var invalidCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 	Help: "Number of stale shares found by worker over time",
 }, append(workerLabels, "type"))
 
+var supersededDiffCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "htn_superseded_diff_share_counter",
+	Help: "Number of shares accepted at the difficulty of their job after vardiff had changed it",
+}, workerLabels)
+
 var blockCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "htn_blochtn_mined",
-	Help: "Number of blocks mined over time",
+	Help: "Number of blocks mined and accepted by the node over time",
+}, workerLabels)
+
+var blockSubmittedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "htn_blocks_submitted",
+	Help: "Number of shares meeting the network target that were submitted to the node as blocks",
 }, workerLabels)
 
 var blockGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
@@ -42,16 +54,31 @@ var blockGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Help: "Gauge containing 1 unique instance per block mined",
 }, append(workerLabels, "nonce", "bluescore", "hash"))
 
+var blockFateCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "htn_block_fate_counter",
+	Help: "Number of submitted blocks by what became of them: blue, red or orphaned",
+}, append(workerLabels, "fate"))
+
+var trackedBlocksGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "htn_blocks_pending_fate",
+	Help: "Submitted blocks whose fate isn't settled yet",
+})
+
 var disconnectCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "htn_worker_disconnect_counter",
-	Help: "Number of disconnects by worker",
-}, workerLabels)
+	Help: "Number of disconnects by worker and reason",
+}, append(workerLabels, "reason"))
 
 var jobCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "htn_worker_job_counter",
 	Help: "Number of jobs sent to the miner by worker over time",
 }, workerLabels)
 
+var writeQueueGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "htn_worker_write_queue_depth",
+	Help: "Outbound messages waiting to be written to the miner when the last job was queued",
+}, workerLabels)
+
 var balanceGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Name: "htn_balance_by_wallet_gauge",
 	Help: "Gauge representing the wallet balance for connected workers",
@@ -77,12 +104,100 @@ var networkBlockCount = promauto.NewGauge(prometheus.GaugeOpts{
 	Help: "Gauge representing the network block count",
 })
 
+var connectionRejectedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "htn_connection_rejected_counter",
+	Help: "Number of incoming connections refused due to connection limits",
+}, []string{"reason"})
+
+var banCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "htn_ban_counter",
+	Help: "Number of bans issued by kind (ip or wallet)",
+}, []string{"kind"})
+
+var extranonceGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "htn_extranonce_gauge",
+	Help: "Extranonces by size and state: active (held by a connected miner), reserved (pinned for a reconnecting worker) or capacity",
+}, []string{"size", "state"})
+
+var extranonceExhaustedCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "htn_extranonce_exhausted_counter",
+	Help: "Number of connections refused because every extranonce was in use",
+})
+
+var sessionCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "htn_session_counter",
+	Help: "Number of miner sessions started, by whether an earlier session was resumed",
+}, []string{"result"})
+
+const (
+	templateFetched = "fetched" // requested from the node
+	templateShared  = "shared"  // joined a request already in flight
+	templateCached  = "cached"  // served from a template fetched earlier in the block
+)
+
+var templateCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "htn_block_template_requests",
+	Help: "Block templates handed to clients by source, everything but fetched is an rpc saved",
+}, []string{"source"})
+
+const (
+	templateEventNotification = "notification"
+	templateEventPoll         = "poll"
+)
+
+var templateEventCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "htn_block_template_events",
+	Help: "New block events handed to the job fan-out by source, notification or poll",
+}, []string{"source"})
+
+var templateModeGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "htn_block_template_mode",
+	Help: "1 for the mode new templates are currently picked up in, notification or poll",
+}, []string{"mode"})
+
+var templateNotificationCoalescedCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "htn_block_template_notifications_coalesced",
+	Help: "Number of notifications folded into one still waiting to be handled",
+})
+
+var templateNotificationDelayHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "htn_block_template_notification_delay_seconds",
+	Help:    "Time from a template notification to the job fan-out starting",
+	Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+})
+
+var jobLatencyHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "htn_job_distribution_seconds",
+	Help:    "Time from the node announcing a new block template, or the template being polled, to the job being queued for the miner",
+	Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+})
+
+var chainTipGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "htn_chain_tip_blue_score",
+	Help: "The node's virtual selected parent blue score that shares are checked for staleness against",
+})
+
+var jobCoalescedCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "htn_job_coalesced_counter",
+	Help: "Number of jobs replaced by a newer block before they were sent",
+})
+
+var jobQueueGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "htn_job_queue_depth",
+	Help: "Clients waiting for a job worker",
+})
+
 func commonLabels(worker *gostratum.StratumContext) prometheus.Labels {
+	port := ""
+	if state, ok := worker.State.(*MiningState); ok {
+		port = state.Port().name
+	}
 	return prometheus.Labels{
 		"worker": worker.WorkerName,
 		"miner":  worker.RemoteApp,
 		"wallet": worker.WalletAddr,
 		"ip":     worker.RemoteAddr,
+		"port":   port,
 	}
 }
 
@@ -103,18 +218,32 @@ func RecordDupeShare(worker *gostratum.StratumContext) {
 	invalidCounter.With(labels).Inc()
 }
 
+func RecordSupersededDiffShare(worker *gostratum.StratumContext) {
+	supersededDiffCounter.With(commonLabels(worker)).Inc()
+}
+
 func RecordInvalidShare(worker *gostratum.StratumContext) {
 	labels := commonLabels(worker)
 	labels["type"] = "invalid"
 	invalidCounter.With(labels).Inc()
 }
 
+func RecordExtranonceViolation(worker *gostratum.StratumContext) {
+	labels := commonLabels(worker)
+	labels["type"] = "extranonce"
+	invalidCounter.With(labels).Inc()
+}
+
 func RecordWeakShare(worker *gostratum.StratumContext) {
 	labels := commonLabels(worker)
 	labels["type"] = "weak"
 	invalidCounter.With(labels).Inc()
 }
 
+func RecordBlockSubmitted(worker *gostratum.StratumContext) {
+	blockSubmittedCounter.With(commonLabels(worker)).Inc()
+}
+
 func RecordBlockFound(worker *gostratum.StratumContext, nonce, bluescore uint64, hash string) {
 	blockCounter.With(commonLabels(worker)).Inc()
 	labels := commonLabels(worker)
@@ -124,12 +253,101 @@ func RecordBlockFound(worker *gostratum.StratumContext, nonce, bluescore uint64,
 	blockGauge.With(labels).Set(1)
 }
 
+// RecordBlockFate takes the labels of the worker that found the block, the
+// client may be long gone by the time its fate is known
+func RecordBlockFate(workerLabels prometheus.Labels, fate string) {
+	labels := prometheus.Labels{"fate": fate}
+	for k, v := range workerLabels {
+		labels[k] = v
+	}
+	blockFateCounter.With(labels).Inc()
+}
+
+func RecordTrackedBlocksPending(count int) {
+	trackedBlocksGauge.Set(float64(count))
+}
+
 func RecordDisconnect(worker *gostratum.StratumContext) {
-	disconnectCounter.With(commonLabels(worker)).Inc()
+	labels := commonLabels(worker)
+	labels["reason"] = string(worker.DisconnectReason())
+	disconnectCounter.With(labels).Inc()
+	writeQueueGauge.Delete(commonLabels(worker))
 }
 
 func RecordNewJob(worker *gostratum.StratumContext) {
 	jobCounter.With(commonLabels(worker)).Inc()
+	writeQueueGauge.With(commonLabels(worker)).Set(float64(worker.QueueDepth()))
+}
+
+func RecordConnectionRejected(reason gostratum.RejectReason) {
+	connectionRejectedCounter.With(prometheus.Labels{
+		"reason": string(reason),
+	}).Inc()
+}
+
+func RecordBan(kind banKind) {
+	banCounter.With(prometheus.Labels{
+		"kind": string(kind),
+	}).Inc()
+}
+
+func RecordExtranonceStats(size int8, active, reserved, capacity uint32) {
+	sizeLabel := strconv.Itoa(int(size))
+	extranonceGauge.With(prometheus.Labels{"size": sizeLabel, "state": "active"}).Set(float64(active))
+	extranonceGauge.With(prometheus.Labels{"size": sizeLabel, "state": "reserved"}).Set(float64(reserved))
+	extranonceGauge.With(prometheus.Labels{"size": sizeLabel, "state": "capacity"}).Set(float64(capacity))
+}
+
+func RecordExtranonceExhausted() {
+	extranonceExhaustedCounter.Inc()
+}
+
+func RecordSession(resumed bool) {
+	result := "new"
+	if resumed {
+		result = "resumed"
+	}
+	sessionCounter.With(prometheus.Labels{"result": result}).Inc()
+}
+
+func RecordTemplateRequest(source string) {
+	templateCounter.With(prometheus.Labels{"source": source}).Inc()
+}
+
+func RecordTemplateEvent(source string, delay time.Duration) {
+	templateEventCounter.With(prometheus.Labels{"source": source}).Inc()
+	if source == templateEventNotification {
+		templateNotificationDelayHistogram.Observe(delay.Seconds())
+	}
+}
+
+func RecordTemplateMode(polling bool) {
+	notify, poll := 1.0, 0.0
+	if polling {
+		notify, poll = 0, 1
+	}
+	templateModeGauge.With(prometheus.Labels{"mode": templateEventNotification}).Set(notify)
+	templateModeGauge.With(prometheus.Labels{"mode": templateEventPoll}).Set(poll)
+}
+
+func RecordTemplateNotificationCoalesced() {
+	templateNotificationCoalescedCounter.Inc()
+}
+
+func RecordJobDistribution(latency time.Duration) {
+	jobLatencyHistogram.Observe(latency.Seconds())
+}
+
+func RecordChainTip(blueScore uint64) {
+	chainTipGauge.Set(float64(blueScore))
+}
+
+func RecordJobCoalesced() {
+	jobCoalescedCounter.Inc()
+}
+
+func RecordJobQueueDepth(depth int) {
+	jobQueueGauge.Set(float64(depth))
 }
 
 func RecordNetworkStats(hashrate uint64, blockCount uint64, difficulty float64) {
@@ -156,15 +374,15 @@ func InitWorkerCounters(worker *gostratum.StratumContext) {
 
 	shareCounter.With(labels).Add(0)
 	shareDiffCounter.With(labels).Add(0)
+	supersededDiffCounter.With(labels).Add(0)
 
-	errTypes := []string{"stale", "duplicate", "invalid", "weak"}
+	errTypes := []string{"stale", "duplicate", "invalid", "extranonce", "weak"}
 	for _, e := range errTypes {
 		InitInvalidCounter(worker, e)
 	}
 
 	blockCounter.With(labels).Add(0)
-
-	disconnectCounter.With(labels).Add(0)
+	blockSubmittedCounter.With(labels).Add(0)
 
 	jobCounter.With(labels).Add(0)
 }
@@ -2,6 +2,7 @@ package htnstratum
 
 import (
 	"testing"
+	"time"
 
 	"github.com/Hoosat-Oy/HTND/app/appmessage"
 	"github.com/Hoosat-Oy/htn-stratum-bridge/src/gostratum"
@@ -17,9 +18,27 @@ func TestPromValid(t *testing.T) {
 	RecordDupeShare(&ctx)
 	RecordInvalidShare(&ctx)
 	RecordWeakShare(&ctx)
+	RecordSupersededDiffShare(&ctx)
+	RecordExtranonceViolation(&ctx)
+	RecordBlockSubmitted(&ctx)
 	RecordBlockFound(&ctx, 10000, 12345, "abcdefg")
+	RecordBlockFate(commonLabels(&ctx), string(fateRed))
+	RecordTrackedBlocksPending(2)
 	RecordDisconnect(&ctx)
 	RecordNewJob(&ctx)
+	RecordConnectionRejected(gostratum.RejectRateLimit)
+	RecordBan(banByIP)
+	RecordExtranonceStats(1, 1, 2, 256)
+	RecordExtranonceExhausted()
+	RecordSession(true)
+	RecordTemplateRequest(templateShared)
+	RecordJobDistribution(time.Millisecond)
+	RecordJobCoalesced()
+	RecordChainTip(12345)
+	RecordTemplateEvent(templateEventNotification, time.Millisecond)
+	RecordTemplateMode(true)
+	RecordTemplateNotificationCoalesced()
+	RecordJobQueueDepth(3)
 	RecordNetworkStats(1234, 5678, 910)
 	RecordWorkerError("localhost", ErrDisconnected)
 	RecordBalances(&appmessage.GetBalancesByAddressesResponseMessage{
@@ -0,0 +1,113 @@
+package htnstratum
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/Hoosat-Oy/htn-stratum-bridge/src/gostratum"
+)
+
+const sessionSweepInterval = time.Minute
+
+// clientSession is what a miner gets back when it reconnects within the grace
+// period presenting its session id: the mining state (jobs, difficulty and
+// whether vardiff is running) and, via the allocator, its extranonce
+type clientSession struct {
+	id       string
+	state    *MiningState
+	clientId int32     // client currently attached, 0 if detached
+	expires  time.Time // only meaningful once detached
+}
+
+// sessionStore keeps the sessions of recently disconnected miners. A nil
+// store (resumption disabled) keeps nothing
+type sessionStore struct {
+	lock      sync.Mutex
+	grace     time.Duration
+	sessions  map[string]*clientSession
+	lastSweep time.Time
+	clock     func() time.Time
+}
+
+func newSessionStore(grace time.Duration) *sessionStore {
+	return &sessionStore{
+		grace:    grace,
+		sessions: map[string]*clientSession{},
+		clock:    time.Now,
+	}
+}
+
+func newSessionId() string {
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+func (ss *sessionStore) sweep(now time.Time) {
+	ss.lastSweep = now
+	for id, session := range ss.sessions {
+		if session.clientId == 0 && now.After(session.expires) {
+			delete(ss.sessions, id)
+		}
+	}
+}
+
+// Resume attaches the client to the requested session if it's still within
+// its grace period and was started on the same port, restoring its mining
+// state. A client that authorized before subscribing may already be getting
+// jobs on its current state, so it isn't swapped. Otherwise the client keeps
+// the session it already has, or a new one is started. A client only ever
+// has one session, resuming another one drops the one it had. Returns the
+// session and whether it was resumed
+func (ss *sessionStore) Resume(ctx *gostratum.StratumContext, requested string) (*clientSession, bool) {
+	if ss == nil {
+		return nil, false
+	}
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	now := ss.clock()
+	if now.Sub(ss.lastSweep) > sessionSweepInterval {
+		ss.sweep(now)
+	}
+	current, attached := ss.sessions[ctx.SessionId]
+	attached = attached && current.clientId == ctx.Id
+	if session, exists := ss.sessions[requested]; exists && requested != "" &&
+		session.clientId == 0 && !now.After(session.expires) &&
+		session.state.port == GetMiningState(ctx).port && !ctx.Authorized() {
+		if attached {
+			delete(ss.sessions, current.id)
+		}
+		session.clientId = ctx.Id
+		ctx.State = session.state
+		ctx.SessionId = session.id
+		return session, true
+	}
+	if attached {
+		return current, false
+	}
+	session := &clientSession{
+		id:       newSessionId(),
+		state:    GetMiningState(ctx),
+		clientId: ctx.Id,
+	}
+	ss.sessions[session.id] = session
+	ctx.SessionId = session.id
+	return session, false
+}
+
+// Detach starts the grace period for the client's session
+func (ss *sessionStore) Detach(ctx *gostratum.StratumContext) {
+	if ss == nil || ctx.SessionId == "" {
+		return
+	}
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	session, exists := ss.sessions[ctx.SessionId]
+	if !exists || session.clientId != ctx.Id {
+		return
+	}
+	session.clientId = 0
+	session.expires = ss.clock().Add(ss.grace)
+}
@@ -0,0 +1,160 @@
+package htnstratum
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Hoosat-Oy/HTND/app/appmessage"
+	"github.com/Hoosat-Oy/htn-stratum-bridge/src/gostratum"
+	"go.uber.org/zap"
+)
+
+func TestSessionResumption(t *testing.T) {
+	now := time.Now()
+	extranonces := newExtranonceAllocator(1, 0)
+	cl := newClientListener(zap.NewNop().Sugar(), newShareHandler(nil, nil), nil, nil)
+	cl.sessions = newSessionStore(time.Minute)
+	cl.sessions.clock = func() time.Time { return now }
+	extranonces.clock = cl.sessions.clock
+	port := &stratumPort{name: ":5555", minShareDiff: 4, extranonces: extranonces}
+
+	connect := func() *gostratum.StratumContext {
+		ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), port.stateGenerator())
+		cl.OnConnect(ctx)
+		return ctx
+	}
+
+	first := connect()
+	if cl.resumeSession(first, "") {
+		t.Fatalf("resumed without a session id")
+	}
+	if first.SessionId == "" {
+		t.Fatalf("no session id assigned")
+	}
+	state := GetMiningState(first)
+	jobId := state.AddJob(&appmessage.RPCBlock{})
+	state.stratumDiff = newHoosatDiff()
+	state.stratumDiff.setDiffValue(64)
+	state.initialized = true
+	extranonce := first.Extranonce
+	cl.OnDisconnect(first)
+
+	// another miner connecting meanwhile mustn't get the held extranonce
+	other := connect()
+	if other.Extranonce == extranonce {
+		t.Fatalf("held extranonce %s handed to another client", extranonce)
+	}
+
+	second := connect()
+	if !cl.resumeSession(second, first.SessionId) {
+		t.Fatalf("failed resuming session")
+	}
+	if second.Extranonce != extranonce {
+		t.Fatalf("expected extranonce %s restored, got %s", extranonce, second.Extranonce)
+	}
+	restored := GetMiningState(second)
+	if _, exists := restored.GetJob(jobId); !exists {
+		t.Fatalf("jobs not restored")
+	}
+	if restored.stratumDiff.diffValue != 64 {
+		t.Fatalf("difficulty not restored, got %f", restored.stratumDiff.diffValue)
+	}
+
+	// a session can't be resumed twice at once, nor after the grace period
+	third := connect()
+	if cl.resumeSession(third, first.SessionId) {
+		t.Fatalf("resumed a session that's still attached")
+	}
+	cl.OnDisconnect(second)
+	now = now.Add(2 * time.Minute)
+	fourth := connect()
+	if cl.resumeSession(fourth, first.SessionId) {
+		t.Fatalf("resumed an expired session")
+	}
+}
+
+func TestSessionResubscribe(t *testing.T) {
+	now := time.Now()
+	extranonces := newExtranonceAllocator(1, 0)
+	cl := newClientListener(zap.NewNop().Sugar(), newShareHandler(nil, nil), nil, nil)
+	cl.sessions = newSessionStore(time.Minute)
+	cl.sessions.clock = func() time.Time { return now }
+	extranonces.clock = cl.sessions.clock
+	port := &stratumPort{name: ":5555", minShareDiff: 4, extranonces: extranonces}
+	connect := func() *gostratum.StratumContext {
+		ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), port.stateGenerator())
+		cl.OnConnect(ctx)
+		return ctx
+	}
+
+	// subscribing over and over keeps the one session
+	ctx := connect()
+	cl.resumeSession(ctx, "")
+	first := ctx.SessionId
+	for i := 0; i < 10; i++ {
+		cl.resumeSession(ctx, "")
+	}
+	if ctx.SessionId != first || len(cl.sessions.sessions) != 1 {
+		t.Fatalf("resubscribing started new sessions: %d sessions", len(cl.sessions.sessions))
+	}
+	if held := extranonces.held[ctx.Id]; held == nil || len(held.keys) != 1 {
+		t.Fatalf("expected the extranonce held for one session, got %+v", held)
+	}
+
+	// resuming another session drops the one the client had
+	old := connect()
+	cl.resumeSession(old, "")
+	cl.OnDisconnect(old)
+	cl.resumeSession(ctx, old.SessionId)
+	if ctx.SessionId != old.SessionId || len(cl.sessions.sessions) != 1 {
+		t.Fatalf("previous session kept after resuming another, %d sessions", len(cl.sessions.sessions))
+	}
+	if _, pinned := extranonces.pins["session:"+first]; pinned {
+		t.Fatalf("extranonce still held for the dropped session")
+	}
+
+	// once gone nothing is left behind
+	cl.OnDisconnect(ctx)
+	now = now.Add(2 * time.Minute)
+	cl.sessions.sweep(now)
+	extranonces.expirePins()
+	if len(cl.sessions.sessions) != 0 || len(extranonces.pins) != 0 || extranonces.inUse != 0 {
+		t.Fatalf("sessions or extranonces left behind: %d sessions, %d pins, %d in use",
+			len(cl.sessions.sessions), len(extranonces.pins), extranonces.inUse)
+	}
+}
+
+func TestSessionResumptionBeforeJobs(t *testing.T) {
+	cl := newClientListener(zap.NewNop().Sugar(), newShareHandler(nil, nil), nil, nil)
+	cl.sessions = newSessionStore(time.Minute)
+	port := &stratumPort{name: ":5555", minShareDiff: 4, extranonces: newExtranonceAllocator(1, 0)}
+	listener := gostratum.NewListener(gostratum.StratumListenerConfig{
+		Logger: zap.NewNop(),
+		HandlerMap: gostratum.StratumHandlerMap{
+			string(gostratum.StratumMethodAuthorize): func(*gostratum.StratumContext, gostratum.JsonRpcEvent) error { return nil },
+		},
+	})
+
+	// no jobs go out while the mining state can still be swapped
+	ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), port.stateGenerator())
+	cl.OnConnect(ctx)
+	cl.NewBlockAvailable(nil, time.Now(), 0, 0)
+	cl.jobs.lock.Lock()
+	_, scheduled := cl.jobs.clients[ctx]
+	cl.jobs.lock.Unlock()
+	if scheduled {
+		t.Fatalf("job scheduled before the client subscribed")
+	}
+	cl.resumeSession(ctx, "")
+	cl.OnDisconnect(ctx)
+
+	// once authorized jobs may be going out, so the state stays put
+	authorized, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), port.stateGenerator())
+	cl.OnConnect(authorized)
+	listener.HandleEvent(authorized, gostratum.NewEvent("1", string(gostratum.StratumMethodAuthorize), nil))
+	state := GetMiningState(authorized)
+	if cl.resumeSession(authorized, ctx.SessionId) || GetMiningState(authorized) != state {
+		t.Fatalf("authorized client's state swapped for a resumed session")
+	}
+}
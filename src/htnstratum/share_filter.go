@@ -0,0 +1,78 @@
+package htnstratum
+
+import (
+	"strconv"
+	"sync"
+)
+
+// shares remembered by default, each takes about 100 bytes between the map
+// and the ring so the filter stays around 6.5MB
+const defaultShareFilterSize = 65536
+
+// shareKey identifies a share. Job ids are only unique per mining state, so
+// the state's id is part of the job. Only scalars are kept so remembered
+// shares don't hold on to disconnected clients
+type shareKey struct {
+	state      uint64
+	jobId      int64
+	nonce      uint64
+	extranonce uint32
+}
+
+func newShareKey(state *MiningState, jobId int64, nonce uint64, extranonce string) shareKey {
+	// at most 3 bytes of hex, none is 0
+	prefix, _ := strconv.ParseUint(extranonce, 16, 32)
+	return shareKey{state: state.id, jobId: jobId, nonce: nonce, extranonce: uint32(prefix)}
+}
+
+// shareFilter remembers the most recent shares so a resubmitted one is only
+// credited once. Once full the oldest share is forgotten for each new one, a
+// nil filter never reports duplicates
+type shareFilter struct {
+	lock  sync.Mutex
+	seen  map[shareKey]struct{}
+	order []shareKey // ring of the remembered shares, oldest at next once full
+	next  int
+}
+
+func newShareFilter(size int) *shareFilter {
+	if size <= 0 {
+		size = defaultShareFilterSize
+	}
+	return &shareFilter{
+		seen:  make(map[shareKey]struct{}, size),
+		order: make([]shareKey, 0, size),
+	}
+}
+
+// Seen remembers the share, returning whether it already was
+func (sf *shareFilter) Seen(key shareKey) bool {
+	if sf == nil {
+		return false
+	}
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	if _, exists := sf.seen[key]; exists {
+		return true
+	}
+	if len(sf.order) < cap(sf.order) {
+		sf.order = append(sf.order, key)
+	} else {
+		delete(sf.seen, sf.order[sf.next])
+		sf.order[sf.next] = key
+		sf.next = (sf.next + 1) % len(sf.order)
+	}
+	sf.seen[key] = struct{}{}
+	return false
+}
+
+// Forget lets the share be submitted again, e.g. when it couldn't be judged.
+// Its slot in the ring is reused as usual
+func (sf *shareFilter) Forget(key shareKey) {
+	if sf == nil {
+		return
+	}
+	sf.lock.Lock()
+	defer sf.lock.Unlock()
+	delete(sf.seen, key)
+}
@@ -0,0 +1,68 @@
+package htnstratum
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/Hoosat-Oy/HTND/app/appmessage"
+	"github.com/Hoosat-Oy/htn-stratum-bridge/src/gostratum"
+	"go.uber.org/zap"
+)
+
+func TestShareFilter(t *testing.T) {
+	sf := newShareFilter(2)
+	state := MiningStateGenerator().(*MiningState)
+	first := newShareKey(state, 1, 100, "0a")
+	if sf.Seen(first) || !sf.Seen(first) {
+		t.Fatalf("resubmitted share not detected")
+	}
+	for _, other := range []shareKey{
+		newShareKey(state, 2, 100, "0a"),
+		newShareKey(state, 1, 101, "0a"),
+		newShareKey(MiningStateGenerator().(*MiningState), 1, 100, "0a"),
+	} {
+		if sf.Seen(other) {
+			t.Fatalf("distinct share %+v reported as a duplicate", other)
+		}
+	}
+	// bounded, the oldest shares are forgotten
+	if len(sf.seen) != 2 || sf.Seen(first) {
+		t.Fatalf("filter grew past its size")
+	}
+	// the documented size of the filter depends on the key staying small
+	if size := unsafe.Sizeof(shareKey{}); size > 32 {
+		t.Fatalf("share key grew to %d bytes", size)
+	}
+
+	var nilFilter *shareFilter
+	if nilFilter.Seen(first) || nilFilter.Seen(first) {
+		t.Fatalf("nil filter reported a duplicate")
+	}
+}
+
+func TestDuplicateSubmit(t *testing.T) {
+	sh := newShareHandler(nil, nil)
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	go func() {
+		for ctx.Err() == nil {
+			mc.ReadTestDataFromBuffer(func([]byte) {})
+		}
+	}()
+	jobId := GetMiningState(ctx).AddJob(&appmessage.RPCBlock{Header: &appmessage.RPCBlockHeader{}})
+	submit := gostratum.NewEvent("1", "mining.submit", []any{
+		"wallet.worker", fmt.Sprintf("%d", jobId), "0b00000000000123", strings.Repeat("0", 64),
+	})
+
+	// the resubmission is caught before the pow is looked at
+	for i := 0; i < 2; i++ {
+		if err := sh.HandleSubmit(ctx, submit, false); err != nil {
+			t.Fatalf("submit failed: %s", err)
+		}
+	}
+	if sh.overall.StaleShares.Load() != 1 {
+		t.Fatalf("expected 1 duplicate, got %d", sh.overall.StaleShares.Load())
+	}
+}
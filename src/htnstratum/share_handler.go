@@ -26,7 +26,8 @@ import (
 const varDiffThreadSleep = 5
 
 type WorkStats struct {
-	BlocksFound        atomic.Int64
+	BlocksFound        atomic.Int64 // accepted by the node
+	BlocksSubmitted    atomic.Int64
 	SharesFound        atomic.Int64
 	SharesDiff         atomic.Float64
 	StaleShares        atomic.Int64
@@ -37,56 +38,48 @@ type WorkStats struct {
 	VarDiffStartTime   time.Time
 	VarDiffSharesFound atomic.Int64
 	VarDiffWindow      int
+	VarDiffMin         float64 // bounds from the worker's port, 0 for none
+	VarDiffMax         float64
 	MinDiff            atomic.Float64
 }
 
 type shareHandler struct {
-	hoosat       *rpcclient.RPCClient
-	state        *MiningState
-	soloDiff     float64
-	stats        map[string]*WorkStats
-	statsLock    sync.Mutex
-	overall      WorkStats
-	tipBlueScore uint64
+	hoosat      *rpcclient.RPCClient
+	submitBlock func(block *externalapi.DomainBlock, powHash string) (appmessage.RejectReason, error)
+	state       *MiningState
+	soloDiff    float64
+	stats       map[string]*WorkStats
+	statsLock   sync.Mutex
+	overall     WorkStats
+	tip         *chainTip // nil never considers shares stale
+	staleWindow staleWindow
+	bans        *banManager
+	diffGrace   diffGrace
+	dupes       *shareFilter
+	blocks      *blockTracker // follows submitted blocks, nil doesn't
+	submitLock  sync.Mutex
+	inFlight    int           // submits being processed, guarded by submitLock
+	draining    bool          // no new submits are accepted
+	drained     chan struct{} // closed once draining with nothing in flight
+	// reject nonces outside the client's extranonce, disconnecting after
+	// maxExtranonceViolations of them (never if <= 0)
+	enforceExtranonce       bool
+	maxExtranonceViolations int
 }
 
-type BanInfo struct {
-	Address string
-	Times   int
-}
-
-var bans = []BanInfo{}
-
 const bps = 5
 
-func AddressBanned(address string) bool {
-	for _, ban := range bans {
-		if ban.Address == address {
-			if ban.Times > 10 {
-				return true
-			} else {
-				return false
-			}
-		}
-	}
-	return false
-}
-
-func TryToBan(address string) {
-	for i, ban := range bans {
-		if ban.Address == address {
-			bans[i].Times++
-			return
-		}
-	}
-	bans = append(bans, BanInfo{Address: address, Times: 1})
-}
-
-func newShareHandler(hoosat *rpcclient.RPCClient) *shareHandler {
+func newShareHandler(hoosat *rpcclient.RPCClient, bans *banManager) *shareHandler {
 	return &shareHandler{
-		hoosat:    hoosat,
-		stats:     map[string]*WorkStats{},
-		statsLock: sync.Mutex{},
+		hoosat:      hoosat,
+		bans:        bans,
+		stats:       map[string]*WorkStats{},
+		statsLock:   sync.Mutex{},
+		staleWindow: staleWindow{blueScore: defaultStaleBlueScoreWindow},
+		dupes:       newShareFilter(defaultShareFilterSize),
+		submitBlock: func(block *externalapi.DomainBlock, powHash string) (appmessage.RejectReason, error) {
+			return hoosat.SubmitBlock(block, powHash)
+		},
 	}
 }
 
@@ -127,6 +120,7 @@ func (sh *shareHandler) getCreateStats(ctx *gostratum.StratumContext) *WorkStats
 
 type submitInfo struct {
 	jobId    int64
+	job      *miningJob
 	block    *appmessage.RPCBlock
 	state    *MiningState
 	noncestr string
@@ -161,7 +155,7 @@ func validateSubmit(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent)
 		return nil, errors.Wrap(err, "job id is not parsable as an number")
 	}
 	state := GetMiningState(ctx)
-	block, exists := state.GetJob(int(jobId))
+	job, exists := state.getJob(int(jobId))
 	if !exists {
 		RecordWorkerError(ctx.WalletAddr, ErrMissingJob)
 		return nil, fmt.Errorf("job does not exist. stale?")
@@ -184,8 +178,9 @@ func validateSubmit(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent)
 
 	return &submitInfo{
 		jobId:    jobId,
+		job:      job,
 		state:    state,
-		block:    block,
+		block:    job.block,
 		noncestr: strings.Replace(noncestr, "0x", "", 1),
 		powHash:  powHash,
 	}, nil
@@ -196,18 +191,22 @@ var (
 	ErrDupeShare  = fmt.Errorf("duplicate share")
 )
 
-// the max difference between tip blue score and job blue score that we'll accept
-// anything greater than this is considered a stale
-const workWindow = 8
+// nonceInExtranonce checks the nonce lies in the nonce space of the extranonce,
+// i.e. that its leading bytes are the extranonce
+func nonceInExtranonce(noncestr string, extranonce string) bool {
+	if extranonce == "" {
+		return true
+	}
+	if len(noncestr) < 16 {
+		noncestr = strings.Repeat("0", 16-len(noncestr)) + noncestr
+	}
+	return strings.HasPrefix(strings.ToLower(noncestr), strings.ToLower(extranonce))
+}
 
+// checkStales compares the job against the node's chain tip
 func (sh *shareHandler) checkStales(ctx *gostratum.StratumContext, si *submitInfo) error {
-	tip := sh.tipBlueScore
-	if si.block.Header.BlueScore > tip {
-		sh.tipBlueScore = si.block.Header.BlueScore
-		return nil // can't be stale
-	}
-	if tip-si.block.Header.BlueScore > workWindow {
-		RecordStaleShare(ctx)
+	if sh.tip.IsStale(si.block.Header.BlueScore, sh.staleWindow) {
+		tip, _ := sh.tip.BlueScore()
 		return errors.Wrapf(ErrStaleShare, "blueScore %d vs %d", si.block.Header.BlueScore, tip)
 	}
 	return nil
@@ -218,6 +217,12 @@ func (sh *shareHandler) setSoloDiff(diff float64) {
 }
 
 func (sh *shareHandler) HandleSubmit(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent, soloMining bool) error {
+	if !sh.beginSubmit() {
+		// the miner is being asked to reconnect elsewhere, keep it connected
+		// until it does
+		return ctx.ReplyShuttingDown(event.Id)
+	}
+	defer sh.endSubmit()
 	state := GetMiningState(ctx)
 	submitInfo, err := validateSubmit(ctx, event)
 	if err != nil {
@@ -225,6 +230,7 @@ func (sh *shareHandler) HandleSubmit(ctx *gostratum.StratumContext, event gostra
 			RecordStaleShare(ctx)
 			return ctx.ReplyStaleShare(event.Id)
 		}
+		sh.bans.RecordMalformed(ctx)
 		return ctx.ReplyIncorrectData(event.Id)
 	}
 
@@ -240,20 +246,28 @@ func (sh *shareHandler) HandleSubmit(ctx *gostratum.StratumContext, event gostra
 	// }
 
 	//ctx.Logger.Debug(submitInfo.block.Header.BlueScore, " submit ", submitInfo.noncestr)
-	if state.useBigJob {
-		submitInfo.nonceVal, err = strconv.ParseUint(submitInfo.noncestr, 16, 64)
-		if err != nil {
-			RecordWorkerError(ctx.WalletAddr, ErrBadDataFromMiner)
-			return errors.Wrap(err, "failed parsing noncestr")
-		}
-	} else {
-		submitInfo.nonceVal, err = strconv.ParseUint(submitInfo.noncestr, 16, 64)
-		if err != nil {
-			RecordWorkerError(ctx.WalletAddr, ErrBadDataFromMiner)
-			return errors.Wrap(err, "failed parsing noncestr")
-		}
+	submitInfo.nonceVal, err = state.Profile().parseNonce(submitInfo.noncestr)
+	if err != nil {
+		RecordWorkerError(ctx.WalletAddr, ErrBadDataFromMiner)
+		sh.bans.RecordMalformed(ctx)
+		return errors.Wrap(err, "failed parsing noncestr")
 	}
 	stats := sh.getCreateStats(ctx)
+	if sh.enforceExtranonce && !state.Profile().NoExtranonceCheck &&
+		!nonceInExtranonce(submitInfo.noncestr, ctx.Extranonce) {
+		stats.InvalidShares.Add(1)
+		sh.overall.InvalidShares.Add(1)
+		RecordExtranonceViolation(ctx)
+		sh.bans.RecordShare(ctx, false)
+		state.extranonceViolations++
+		ctx.Logger.Warn(fmt.Sprintf("nonce %s outside of assigned extranonce %s", submitInfo.noncestr, ctx.Extranonce))
+		err := ctx.ReplyBadExtranonce(event.Id)
+		if sh.maxExtranonceViolations > 0 && state.extranonceViolations >= sh.maxExtranonceViolations {
+			ctx.Logger.Warn("too many nonces outside of assigned extranonce, disconnecting")
+			go ctx.Disconnect()
+		}
+		return err
+	}
 	if err := sh.checkStales(ctx, submitInfo); err != nil {
 		// remove job since it is bad job, so the job won't be reused for submit.
 		state := GetMiningState(ctx)
@@ -269,6 +283,13 @@ func (sh *shareHandler) HandleSubmit(ctx *gostratum.StratumContext, event gostra
 		RecordInvalidShare(ctx)
 		return ctx.ReplyBadShare(event.Id)
 	}
+	key := newShareKey(state, submitInfo.jobId, submitInfo.nonceVal, ctx.Extranonce)
+	if sh.dupes.Seen(key) {
+		stats.StaleShares.Add(1)
+		sh.overall.StaleShares.Add(1)
+		RecordDupeShare(ctx)
+		return ctx.ReplyDupeShare(event.Id)
+	}
 
 	// jsonHeader, err := json.MarshalIndent(submitInfo.block, "", "\t")
 	// if err != nil {
@@ -278,6 +299,7 @@ func (sh *shareHandler) HandleSubmit(ctx *gostratum.StratumContext, event gostra
 	converted, err := appmessage.RPCBlockToDomainBlock(submitInfo.block, submitInfo.powHash.String())
 	if err != nil {
 		RecordInvalidShare(ctx)
+		sh.bans.RecordShare(ctx, false)
 		return ctx.ReplyIncorrectData(event.Id)
 	}
 	mutableHeader := converted.Header.ToMutable()
@@ -288,64 +310,138 @@ func (sh *shareHandler) HandleSubmit(ctx *gostratum.StratumContext, event gostra
 	recalculatedPowNum, _ := powState.CalculateProofOfWorkValue()
 	submittedPowNum := toBig(submitInfo.powHash)
 
-	// The block hash must be less or equal than the claimed target.
-	//fmt.Printf("%s\r\n", submittedPowNum)
-	//fmt.Printf("%s\r\n", recalculatedPowNum)
-	if submittedPowNum.Cmp(recalculatedPowNum) == 0 {
-		if recalculatedPowNum.Cmp(&powState.Target) <= 0 {
-			if err := sh.submit(ctx, converted, submitInfo, event.Id); err != nil {
-				if strings.Contains(err.Error(), "ErrDuplicateBlock") {
-					ctx.Logger.Warn("block rejected, duplicate")
-					stats.StaleShares.Add(1)
-					sh.overall.StaleShares.Add(1)
-					RecordDupeShare(ctx)
-					return ctx.ReplyDupeShare(event.Id)
-				} else if strings.Contains(err.Error(), "ErrInvalidPoW") {
-					ctx.Logger.Warn("block rejected, incorred pow")
-					stats.StaleShares.Add(1)
-					sh.overall.InvalidShares.Add(1)
-					RecordInvalidShare(ctx)
-					return ctx.ReplyIncorrectPow(event.Id)
-				} else {
-					ctx.Logger.Warn("block rejected, unknown issue", zap.Error(err))
-					stats.InvalidShares.Add(1)
-					sh.overall.InvalidShares.Add(1)
-					RecordInvalidShare(ctx)
-					return ctx.ReplyBadShare(event.Id)
-				}
-			}
-		} else if recalculatedPowNum.Cmp(state.stratumDiff.targetValue) >= 0 {
-			if soloMining {
-				ctx.Logger.Warn("weak block")
-			} else {
-				ctx.Logger.Warn("weak share")
-			}
-			stats.InvalidShares.Add(1)
-			sh.overall.InvalidShares.Add(1)
-			RecordWeakShare(ctx)
-			return ctx.ReplyLowDiffShare(event.Id)
-		}
-	} else {
+	// shares are held to the difficulty of the job they're for, vardiff may
+	// have moved on since it was sent
+	diff, superseded := state.shareDiff(submitInfo.job, sh.diffGrace, time.Now())
+	switch classifyShare(submittedPowNum, recalculatedPowNum, &powState.Target, diff.targetValue) {
+	case shareInvalid:
 		stats.InvalidShares.Add(1)
 		sh.overall.InvalidShares.Add(1)
 		RecordInvalidShare(ctx)
+		sh.bans.RecordShare(ctx, false)
 		return ctx.ReplyIncorrectPow(event.Id)
+	case shareWeak:
+		if soloMining {
+			ctx.Logger.Warn("weak block")
+		} else {
+			ctx.Logger.Warn("weak share")
+		}
+		stats.InvalidShares.Add(1)
+		sh.overall.InvalidShares.Add(1)
+		RecordWeakShare(ctx)
+		sh.bans.RecordShare(ctx, false)
+		return ctx.ReplyLowDiffShare(event.Id)
+	case shareBlock:
+		sh.recordBlockSubmitted(ctx, stats)
+		submitted, reason, err := sh.submit(ctx, converted, submitInfo)
+		if err != nil {
+			if isDuplicateBlock(err) {
+				ctx.Logger.Warn("block rejected, duplicate")
+				stats.StaleShares.Add(1)
+				sh.overall.StaleShares.Add(1)
+				RecordDupeShare(ctx)
+				return ctx.ReplyDupeShare(event.Id)
+			} else if strings.Contains(err.Error(), "ErrInvalidPoW") {
+				ctx.Logger.Warn("block rejected, incorred pow")
+				stats.StaleShares.Add(1)
+				sh.overall.InvalidShares.Add(1)
+				RecordInvalidShare(ctx)
+				sh.bans.RecordShare(ctx, false)
+				return ctx.ReplyIncorrectPow(event.Id)
+			} else {
+				if !isBlockRejection(reason, err) {
+					// the node never judged the block, let the miner resend it
+					sh.dupes.Forget(key)
+				}
+				ctx.Logger.Warn("block rejected, unknown issue", zap.Error(err))
+				stats.InvalidShares.Add(1)
+				sh.overall.InvalidShares.Add(1)
+				RecordInvalidShare(ctx)
+				return ctx.ReplyBadShare(event.Id)
+			}
+		}
+		sh.recordBlockAccepted(ctx, stats, submitted)
 	}
 
+	sh.recordShare(ctx, stats, diff.hashValue)
+	if superseded {
+		RecordSupersededDiffShare(ctx)
+	}
+	ctx.ReplySuccess(event.Id)
+	return nil
+}
+
+// recordShare counts a share that met the stratum target, blocks included
+func (sh *shareHandler) recordShare(ctx *gostratum.StratumContext, stats *WorkStats, diff float64) {
 	stats.SharesFound.Add(1)
-	stats.SharesDiff.Add(state.stratumDiff.hashValue)
+	stats.SharesDiff.Add(diff)
 	stats.LastShare = time.Now()
 	sh.overall.SharesFound.Add(1)
-	RecordShareFound(ctx, state.stratumDiff.hashValue)
+	RecordShareFound(ctx, diff)
+	sh.bans.RecordShare(ctx, true)
+}
+
+// recordBlockSubmitted counts a share that met the network target, before
+// the node has had its say
+func (sh *shareHandler) recordBlockSubmitted(ctx *gostratum.StratumContext, stats *WorkStats) {
+	stats.BlocksSubmitted.Add(1)
+	sh.overall.BlocksSubmitted.Add(1)
+	RecordBlockSubmitted(ctx)
+}
+
+// recordBlockAccepted counts a block the node accepted
+func (sh *shareHandler) recordBlockAccepted(ctx *gostratum.StratumContext, stats *WorkStats, block *externalapi.DomainBlock) {
 	stats.BlocksFound.Add(1)
 	sh.overall.BlocksFound.Add(1)
-	RecordBlockFound(ctx, converted.Header.Nonce(), converted.Header.BlueScore(), consensushashing.BlockHash(converted).String())
-	ctx.ReplySuccess(event.Id)
-	return nil
+	RecordBlockFound(ctx, block.Header.Nonce(), block.Header.BlueScore(), consensushashing.BlockHash(block).String())
 }
 
-func (sh *shareHandler) submit(ctx *gostratum.StratumContext,
-	block *externalapi.DomainBlock, submitInfo *submitInfo, eventId any) error {
+// drainSubmissions stops accepting submits and waits for the in-flight ones,
+// including any block submissions to the node, returning false if they didn't
+// finish within the timeout
+func (sh *shareHandler) drainSubmissions(timeout time.Duration) bool {
+	sh.submitLock.Lock()
+	if !sh.draining {
+		sh.draining = true
+		sh.drained = make(chan struct{})
+		if sh.inFlight == 0 {
+			close(sh.drained)
+		}
+	}
+	drained := sh.drained
+	sh.submitLock.Unlock()
+	select {
+	case <-drained:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// beginSubmit counts a submit as in flight, false once draining
+func (sh *shareHandler) beginSubmit() bool {
+	sh.submitLock.Lock()
+	defer sh.submitLock.Unlock()
+	if sh.draining {
+		return false
+	}
+	sh.inFlight++
+	return true
+}
+
+func (sh *shareHandler) endSubmit() {
+	sh.submitLock.Lock()
+	defer sh.submitLock.Unlock()
+	sh.inFlight--
+	if sh.draining && sh.inFlight == 0 {
+		close(sh.drained)
+	}
+}
+
+// submit sends the template with the miner's nonce to the node, returning
+// the block as submitted and the node's verdict on it
+func (sh *shareHandler) submit(ctx *gostratum.StratumContext, block *externalapi.DomainBlock,
+	submitInfo *submitInfo) (*externalapi.DomainBlock, appmessage.RejectReason, error) {
 	mutable := block.Header.ToMutable()
 	mutable.SetNonce(submitInfo.nonceVal)
 	block = &externalapi.DomainBlock{
@@ -353,9 +449,14 @@ func (sh *shareHandler) submit(ctx *gostratum.StratumContext,
 		Transactions: block.Transactions,
 	}
 	state := GetMiningState(ctx)
-	_, err := sh.hoosat.SubmitBlock(block, submitInfo.powHash.String())
-	state.RemoveJob(int(submitInfo.jobId))
-	return err
+	reason, err := sh.submitBlock(block, submitInfo.powHash.String())
+	if err == nil || isDuplicateBlock(err) || isBlockRejection(reason, err) {
+		// the node has judged the block, otherwise the job is kept so the
+		// miner can resend it
+		state.RemoveJob(int(submitInfo.jobId))
+	}
+	sh.blocks.Track(ctx, block, submitInfo.jobId, reason, err)
+	return block, reason, err
 }
 
 func (sh *shareHandler) startStatsThread() error {
@@ -365,7 +466,7 @@ func (sh *shareHandler) startStatsThread() error {
 		time.Sleep(10 * time.Second)
 		sh.statsLock.Lock()
 		str := "\n===============================================================================\n"
-		str += "  worker name   |  avg hashrate  |   acc/stl/inv  |    blocks    |    uptime   \n"
+		str += "  worker name   |  avg hashrate  |   acc/stl/inv  |  blocks/sub  |    uptime   \n"
 		str += "-------------------------------------------------------------------------------\n"
 		var lines []string
 		totalRate := float64(0)
@@ -374,16 +475,18 @@ func (sh *shareHandler) startStatsThread() error {
 			totalRate += rate
 			rateStr := stringifyHashrate(rate)
 			ratioStr := fmt.Sprintf("%d/%d/%d", v.SharesFound.Load(), v.StaleShares.Load(), v.InvalidShares.Load())
-			lines = append(lines, fmt.Sprintf(" %-15s| %14.14s | %14.14s | %12d | %11s",
-				v.WorkerName, rateStr, ratioStr, v.BlocksFound.Load(), time.Since(v.StartTime).Round(time.Second)))
+			blocksStr := fmt.Sprintf("%d/%d", v.BlocksFound.Load(), v.BlocksSubmitted.Load())
+			lines = append(lines, fmt.Sprintf(" %-15s| %14.14s | %14.14s | %12.12s | %11s",
+				v.WorkerName, rateStr, ratioStr, blocksStr, time.Since(v.StartTime).Round(time.Second)))
 		}
 		sort.Strings(lines)
 		str += strings.Join(lines, "\n")
 		rateStr := stringifyHashrate(totalRate)
 		ratioStr := fmt.Sprintf("%d/%d/%d", sh.overall.SharesFound.Load(), sh.overall.StaleShares.Load(), sh.overall.InvalidShares.Load())
 		str += "\n-------------------------------------------------------------------------------\n"
-		str += fmt.Sprintf("                | %14.14s | %14.14s | %12d | %11s",
-			rateStr, ratioStr, sh.overall.BlocksFound.Load(), time.Since(start).Round(time.Second))
+		blocksStr := fmt.Sprintf("%d/%d", sh.overall.BlocksFound.Load(), sh.overall.BlocksSubmitted.Load())
+		str += fmt.Sprintf("                | %14.14s | %14.14s | %12.12s | %11s",
+			rateStr, ratioStr, blocksStr, time.Since(start).Round(time.Second))
 		str += "\n-------------------------------------------------------------------------------\n"
 		str += " Est. Network Hashrate: " + stringifyHashrate(DiffToHash(sh.soloDiff)*bps) + "\n"
 		str += " Mining difficulty:     " + fmt.Sprintf("%f", sh.soloDiff)
@@ -534,6 +637,12 @@ func (sh *shareHandler) startVardiffThread(expectedShareRate uint, logStats bool
 // update vardiff with new mindiff, reset counters, and disable tracker until
 // client handler restarts it while sending diff on next block
 func updateVarDiff(stats *WorkStats, minDiff float64) float64 {
+	if stats.VarDiffMin > 0 && minDiff < stats.VarDiffMin {
+		minDiff = stats.VarDiffMin
+	}
+	if stats.VarDiffMax > 0 && minDiff > stats.VarDiffMax {
+		minDiff = stats.VarDiffMax
+	}
 	stats.VarDiffStartTime = time.Time{}
 	stats.VarDiffWindow = 0
 	previousMinDiff := stats.MinDiff.Load()
@@ -549,7 +658,16 @@ func startVarDiff(stats *WorkStats) {
 	}
 }
 
+// vardiffEnabled says whether the client's port adjusts its difficulty
+func vardiffEnabled(ctx *gostratum.StratumContext) bool {
+	port := GetMiningState(ctx).Port()
+	return port.varDiff || port.soloMining
+}
+
 func (sh *shareHandler) startClientVardiff(ctx *gostratum.StratumContext) {
+	if !vardiffEnabled(ctx) {
+		return
+	}
 	stats := sh.getCreateStats(ctx)
 	startVarDiff(stats)
 }
@@ -561,7 +679,11 @@ func (sh *shareHandler) getClientVardiff(ctx *gostratum.StratumContext) float64
 
 func (sh *shareHandler) setClientVardiff(ctx *gostratum.StratumContext, minDiff float64) float64 {
 	stats := sh.getCreateStats(ctx)
+	port := GetMiningState(ctx).Port()
+	stats.VarDiffMin, stats.VarDiffMax = port.varDiffMin, port.varDiffMax
 	previousMinDiff := updateVarDiff(stats, math.Max(minDiff, 0.00001))
-	startVarDiff(stats)
+	if vardiffEnabled(ctx) {
+		startVarDiff(stats)
+	}
 	return previousMinDiff
 }
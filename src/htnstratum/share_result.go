@@ -0,0 +1,43 @@
+package htnstratum
+
+import "math/big"
+
+// shareResult is what a submitted nonce turned out to be. Only a block is
+// submitted to the node, and only a block the node accepts counts as found
+type shareResult int
+
+const (
+	shareInvalid  shareResult = iota // pow doesn't match the submitted hash
+	shareWeak                        // doesn't meet the stratum target
+	shareAccepted                    // meets the stratum target but not the network's
+	shareBlock                       // meets the network target as well
+)
+
+func (r shareResult) String() string {
+	switch r {
+	case shareInvalid:
+		return "invalid"
+	case shareWeak:
+		return "weak"
+	case shareAccepted:
+		return "share"
+	case shareBlock:
+		return "block"
+	}
+	return "unknown"
+}
+
+// classifyShare checks the recalculated pow against the claimed one and the
+// targets, a block also meets the stratum target so is always a valid share
+func classifyShare(submitted, recalculated, networkTarget, stratumTarget *big.Int) shareResult {
+	if submitted.Cmp(recalculated) != 0 {
+		return shareInvalid
+	}
+	if recalculated.Cmp(networkTarget) <= 0 {
+		return shareBlock
+	}
+	if recalculated.Cmp(stratumTarget) >= 0 {
+		return shareWeak
+	}
+	return shareAccepted
+}
@@ -0,0 +1,156 @@
+package htnstratum
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/Hoosat-Oy/HTND/app/appmessage"
+	"github.com/Hoosat-Oy/HTND/domain/consensus/model/externalapi"
+	"github.com/Hoosat-Oy/HTND/domain/consensus/utils/consensushashing"
+	"github.com/Hoosat-Oy/HTND/domain/consensus/utils/pow"
+	"github.com/Hoosat-Oy/htn-stratum-bridge/src/gostratum"
+	"go.uber.org/zap"
+)
+
+func TestClassifyShare(t *testing.T) {
+	network := big.NewInt(100)
+	stratum := big.NewInt(1000)
+	cases := []struct {
+		name         string
+		submitted    int64
+		recalculated int64
+		expected     shareResult
+	}{
+		{"pow mismatch", 50, 60, shareInvalid},
+		{"above stratum target", 1000, 1000, shareWeak},
+		{"meets stratum target", 500, 500, shareAccepted},
+		{"meets network target", 100, 100, shareBlock},
+	}
+	for _, c := range cases {
+		result := classifyShare(big.NewInt(c.submitted), big.NewInt(c.recalculated), network, stratum)
+		if result != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.name, c.expected, result)
+		}
+	}
+}
+
+func TestHandleSubmitBranches(t *testing.T) {
+	var submitted *externalapi.DomainBlock
+	var submitErr error
+	var submitReason appmessage.RejectReason
+	sh := newShareHandler(nil, nil)
+	sh.blocks = newBlockTracker(nil, nil)
+	sh.submitBlock = func(block *externalapi.DomainBlock, powHash string) (appmessage.RejectReason, error) {
+		submitted = block
+		return submitReason, submitErr
+	}
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	ctx.WorkerName = "worker"
+	go func() {
+		for ctx.Err() == nil {
+			mc.ReadTestDataFromBuffer(func([]byte) {})
+		}
+	}()
+	state := GetMiningState(ctx)
+	stats := sh.getCreateStats(ctx)
+
+	const nonce = "0b00000000000123"
+	// submit sends a share on a new job, the network target coming from bits,
+	// with either the correct pow hash or a wrong one
+	send := func(event gostratum.JsonRpcEvent) {
+		t.Helper()
+		if err := sh.HandleSubmit(ctx, event, false); err != nil {
+			t.Fatalf("submit failed: %s", err)
+		}
+	}
+	templates := int64(0)
+	submit := func(bits uint32, stratumDiff float64, correctPow bool) gostratum.JsonRpcEvent {
+		t.Helper()
+		state.setDiff(stratumDiff)
+		templates++ // every job is a different block
+		block := &appmessage.RPCBlock{Header: &appmessage.RPCBlockHeader{
+			Version:              1,
+			HashMerkleRoot:       strings.Repeat("0", 64),
+			AcceptedIDMerkleRoot: strings.Repeat("0", 64),
+			UTXOCommitment:       strings.Repeat("0", 64),
+			PruningPoint:         strings.Repeat("0", 64),
+			BlueWork:             "0",
+			Bits:                 bits,
+			Timestamp:            templates,
+		}}
+		jobId := state.AddJob(block)
+		powHash := strings.Repeat("0", 64)
+		if correctPow {
+			converted, err := appmessage.RPCBlockToDomainBlock(block, powHash)
+			if err != nil {
+				t.Fatalf("failed converting block: %s", err)
+			}
+			header := converted.Header.ToMutable()
+			header.SetNonce(0x0b00000000000123)
+			_, hash := pow.NewState(header).CalculateProofOfWorkValue()
+			powHash = hash.String()
+		}
+		event := gostratum.NewEvent("1", "mining.submit", []any{"wallet.worker", fmt.Sprintf("%d", jobId), nonce, powHash})
+		send(event)
+		return event
+	}
+	check := func(branch string, shares, invalid, submittedBlocks, found int64) {
+		t.Helper()
+		for _, s := range []*WorkStats{stats, &sh.overall} {
+			if s.SharesFound.Load() != shares || s.InvalidShares.Load() != invalid ||
+				s.BlocksSubmitted.Load() != submittedBlocks || s.BlocksFound.Load() != found {
+				t.Fatalf("%s: expected %d/%d/%d/%d shares/invalid/submitted/found, got %d/%d/%d/%d", branch,
+					shares, invalid, submittedBlocks, found, s.SharesFound.Load(), s.InvalidShares.Load(),
+					s.BlocksSubmitted.Load(), s.BlocksFound.Load())
+			}
+		}
+	}
+	const (
+		unreachable = 0x03000001 // network target of 1, no share is a block
+		anything    = 0x217fffff // network target above any hash
+	)
+
+	submit(unreachable, 1e-30, false)
+	check("invalid", 0, 1, 0, 0)
+
+	submit(unreachable, 1e30, true)
+	check("weak", 0, 2, 0, 0)
+
+	submit(unreachable, 1e-30, true)
+	check("share", 1, 2, 0, 0)
+	if submitted != nil {
+		t.Fatalf("share submitted as a block")
+	}
+
+	// a block the node rejects is submitted but neither found nor a share
+	submitReason, submitErr = appmessage.RejectReasonBlockInvalid, fmt.Errorf("block rejected")
+	submit(anything, 1e-30, true)
+	check("rejected block", 1, 3, 1, 0)
+
+	// a block the node never got to judge isn't taken for a duplicate when
+	// the miner resends it
+	submitReason, submitErr = appmessage.RejectReasonNone, fmt.Errorf("timeout waiting for response")
+	unjudged := submit(anything, 1e-30, true)
+	check("unjudged block", 1, 4, 2, 0)
+	submitErr = nil
+	send(unjudged)
+	check("resent block", 2, 4, 3, 1)
+	send(unjudged) // credited once only
+	check("resent again", 2, 4, 3, 1)
+
+	// a block the node accepts is found and is a share too, recorded as the
+	// block that was submitted
+	submitted = nil
+	submit(anything, 1e-30, true)
+	check("accepted block", 3, 4, 4, 2)
+	if submitted == nil || submitted.Header.Nonce() != 0x0b00000000000123 {
+		t.Fatalf("block not submitted with the miner's nonce")
+	}
+	report := sh.blocks.Report("", "")
+	if len(report.Blocks) != 3 || report.Blocks[0].Hash != consensushashing.BlockHash(submitted).String() {
+		t.Fatalf("tracked block doesn't match the one submitted")
+	}
+}
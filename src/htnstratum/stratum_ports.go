@@ -0,0 +1,141 @@
+package htnstratum
+
+import (
+	"fmt"
+	"time"
+)
+
+const defaultMinShareDiff = 4
+
+// StratumPortConfig is a listener in stratum_ports. Settings left out fall
+// back to the top level config
+type StratumPortConfig struct {
+	Port           string  `yaml:"port"`
+	MinShareDiff   float64 `yaml:"min_share_diff"`
+	VarDiff        *bool   `yaml:"var_diff"`
+	VarDiffMin     float64 `yaml:"var_diff_min"` // 0 for no bound
+	VarDiffMax     float64 `yaml:"var_diff_max"`
+	SoloMining     *bool   `yaml:"solo_mining"`
+	ExtranonceSize *uint   `yaml:"extranonce_size"`
+	MinerProfile   string  `yaml:"miner_profile"` // use this profile rather than matching the user agent
+}
+
+// stratumPort is the resolved policy for the clients of one listener, held
+// in each client's MiningState
+type stratumPort struct {
+	name         string // listen address, used as the metrics label
+	minShareDiff float64
+	varDiff      bool
+	varDiffMin   float64
+	varDiffMax   float64
+	soloMining   bool
+	extranonces  *extranonceAllocator
+	profile      *MinerProfile // nil to match on the user agent
+}
+
+// defaultPort applies to states that weren't created by a listener, e.g. in
+// tests
+var defaultPort = &stratumPort{minShareDiff: defaultMinShareDiff}
+
+// resolvePorts builds the listener policies from stratum_ports, or from the
+// top level settings if no list is given. Every port handing out extranonces
+// shares a single allocator sized to the largest extranonce_size, since an
+// extranonce on one port would otherwise be the prefix of another's and
+// their miners would search the same nonces
+func resolvePorts(cfg BridgeConfig, profiles *minerProfiles) ([]*stratumPort, error) {
+	configured := cfg.StratumPorts
+	if len(configured) == 0 {
+		configured = []StratumPortConfig{{Port: cfg.StratumPort}}
+	}
+
+	var pinTTL time.Duration
+	if cfg.ExtranoncePinning {
+		pinTTL = cfg.ExtranoncePinTTL
+		if pinTTL <= 0 {
+			pinTTL = defaultExtranoncePinTTL
+		}
+	}
+	var shared *extranonceAllocator
+	if size := largestExtranonceSize(cfg, configured); size > 0 {
+		shared = newExtranonceAllocator(int8(size), pinTTL)
+	}
+
+	ports := make([]*stratumPort, 0, len(configured))
+	seen := map[string]bool{}
+	for _, pc := range configured {
+		if pc.Port == "" {
+			return nil, fmt.Errorf("stratum port with no address configured")
+		}
+		if seen[pc.Port] {
+			return nil, fmt.Errorf("stratum port %s configured twice", pc.Port)
+		}
+		seen[pc.Port] = true
+
+		port := &stratumPort{
+			name:         pc.Port,
+			minShareDiff: pc.MinShareDiff,
+			varDiff:      cfg.VarDiff,
+			varDiffMin:   pc.VarDiffMin,
+			varDiffMax:   pc.VarDiffMax,
+			soloMining:   cfg.SoloMining,
+		}
+		if port.minShareDiff == 0 {
+			port.minShareDiff = cfg.MinShareDiff
+		}
+		if port.minShareDiff == 0 {
+			port.minShareDiff = defaultMinShareDiff
+		}
+		if pc.VarDiff != nil {
+			port.varDiff = *pc.VarDiff
+		}
+		if pc.SoloMining != nil {
+			port.soloMining = *pc.SoloMining
+		}
+		if port.varDiffMax > 0 && port.varDiffMax < port.varDiffMin {
+			return nil, fmt.Errorf("stratum port %s: var_diff_max is below var_diff_min", pc.Port)
+		}
+
+		if portExtranonceSize(cfg, pc) > 0 {
+			port.extranonces = shared
+		}
+
+		if pc.MinerProfile != "" {
+			profile, exists := profiles.ByName(pc.MinerProfile)
+			if !exists {
+				return nil, fmt.Errorf("stratum port %s: unknown miner_profile %s", pc.Port, pc.MinerProfile)
+			}
+			port.profile = profile
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// portExtranonceSize is the port's extranonce_size, or the top level one
+func portExtranonceSize(cfg BridgeConfig, pc StratumPortConfig) uint {
+	size := cfg.ExtranonceSize
+	if pc.ExtranonceSize != nil {
+		size = *pc.ExtranonceSize
+	}
+	if size > 3 {
+		size = 3
+	}
+	return size
+}
+
+func largestExtranonceSize(cfg BridgeConfig, configured []StratumPortConfig) uint {
+	var largest uint
+	for _, pc := range configured {
+		if size := portExtranonceSize(cfg, pc); size > largest {
+			largest = size
+		}
+	}
+	return largest
+}
+
+// stateGenerator creates the mining state for clients of the port
+func (p *stratumPort) stateGenerator() any {
+	state := MiningStateGenerator().(*MiningState)
+	state.port = p
+	return state
+}
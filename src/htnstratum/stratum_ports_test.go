@@ -0,0 +1,109 @@
+package htnstratum
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/Hoosat-Oy/htn-stratum-bridge/src/gostratum"
+	"go.uber.org/zap"
+)
+
+func TestStratumPorts(t *testing.T) {
+	profiles, err := newMinerProfiles(nil)
+	if err != nil {
+		t.Fatalf("failed loading profiles: %s", err)
+	}
+	solo, noVardiff := true, false
+	small := uint(1)
+	cfg := BridgeConfig{
+		StratumPort:    ":5555",
+		MinShareDiff:   8,
+		VarDiff:        true,
+		ExtranonceSize: 2,
+		StratumPorts: []StratumPortConfig{
+			{Port: ":5555"},
+			{Port: ":5556", MinShareDiff: 4096, VarDiffMin: 1024, VarDiffMax: 8192},
+			{Port: ":5557", SoloMining: &solo, VarDiff: &noVardiff, ExtranonceSize: &small, MinerProfile: "bzminer"},
+		},
+	}
+	ports, err := resolvePorts(cfg, profiles)
+	if err != nil {
+		t.Fatalf("failed resolving ports: %s", err)
+	}
+	if len(ports) != 3 {
+		t.Fatalf("expected 3 ports, got %d", len(ports))
+	}
+	if ports[0].minShareDiff != 8 || !ports[0].varDiff || ports[0].soloMining {
+		t.Errorf("defaults not inherited: %+v", ports[0])
+	}
+	if ports[1].minShareDiff != 4096 {
+		t.Errorf("expected start diff 4096, got %f", ports[1].minShareDiff)
+	}
+	if !ports[2].soloMining || ports[2].varDiff || ports[2].profile == nil || ports[2].profile.Name != "bzminer" {
+		t.Errorf("overrides not applied: %+v", ports[2])
+	}
+	// a 1 byte extranonce on one port would be the prefix of 2 byte ones on
+	// the others, so all of them share one allocator at the larger size
+	if ports[0].extranonces != ports[1].extranonces || ports[2].extranonces != ports[0].extranonces ||
+		ports[0].extranonces.size != 2 {
+		t.Errorf("expected every port to share a 2 byte allocator")
+	}
+	first, _ := ports[0].extranonces.Allocate(1)
+	second, _ := ports[2].extranonces.Allocate(2)
+	if strings.HasPrefix(first, second) || strings.HasPrefix(second, first) {
+		t.Errorf("extranonces %s and %s overlap across ports", first, second)
+	}
+	none := uint(0)
+	mixed, err := resolvePorts(BridgeConfig{ExtranonceSize: 1, StratumPorts: []StratumPortConfig{
+		{Port: ":5555"}, {Port: ":5556", ExtranonceSize: &none},
+	}}, profiles)
+	if err != nil || mixed[0].extranonces == nil || mixed[1].extranonces != nil {
+		t.Errorf("extranonce_size 0 should disable extranonces on its port only")
+	}
+
+	for _, bad := range [][]StratumPortConfig{
+		{{Port: ":5555"}, {Port: ":5555"}},
+		{{Port: ":5555", VarDiffMin: 10, VarDiffMax: 5}},
+		{{Port: ":5555", MinerProfile: "nope"}},
+		{{}},
+	} {
+		if _, err := resolvePorts(BridgeConfig{StratumPorts: bad}, profiles); err == nil {
+			t.Errorf("expected %+v to be rejected", bad)
+		}
+	}
+
+	legacy, err := resolvePorts(BridgeConfig{StratumPort: ":5555"}, profiles)
+	if err != nil || len(legacy) != 1 || legacy[0].name != ":5555" || legacy[0].minShareDiff != defaultMinShareDiff {
+		t.Errorf("single stratum_port not resolved: %+v, %v", legacy, err)
+	}
+
+	// vardiff stays within the port's bounds, and ports without vardiff
+	// never start a tracker
+	sh := newShareHandler(nil, nil)
+	ctx, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), ports[1].stateGenerator())
+	ctx.WorkerName = "bounded"
+	sh.setClientVardiff(ctx, ports[1].minShareDiff)
+	stats := sh.getCreateStats(ctx)
+	updateVarDiff(stats, 100000)
+	if diff := stats.MinDiff.Load(); diff != 8192 {
+		t.Errorf("expected diff clamped to 8192, got %f", diff)
+	}
+	updateVarDiff(stats, 1)
+	if diff := stats.MinDiff.Load(); diff != 1024 {
+		t.Errorf("expected diff clamped to 1024, got %f", diff)
+	}
+
+	fixedPort := &stratumPort{name: ":5559", minShareDiff: 1}
+	fixed, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), fixedPort.stateGenerator())
+	fixed.WorkerName = "fixed"
+	sh.setClientVardiff(fixed, 1)
+	sh.startClientVardiff(fixed)
+	if !sh.getCreateStats(fixed).VarDiffStartTime.IsZero() {
+		t.Errorf("vardiff tracker started on a fixed difficulty port")
+	}
+
+	if label := commonLabels(ctx)["port"]; label != ":5556" {
+		t.Errorf("expected port label :5556, got %q", label)
+	}
+}
@@ -6,34 +6,92 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/Hoosat-Oy/htn-stratum-bridge/src/gostratum"
 	"github.com/mattn/go-colorable"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
 const version = "v1.6.0"
 const minBlockWaitTime = 100 * time.Millisecond
+const defaultAuthorizeTimeout = 20 * time.Second
+const defaultShutdownTimeout = 30 * time.Second
+const defaultExtranonceStrikes = 10
 
 type BridgeConfig struct {
-	StratumPort       string        `yaml:"stratum_port"`
-	RPCServer         string        `yaml:"hoosat_address"`
-	PromPort          string        `yaml:"prom_port"`
-	PrintStats        bool          `yaml:"print_stats"`
-	UseLogFile        bool          `yaml:"log_to_file"`
-	HealthCheckPort   string        `yaml:"health_check_port"`
-	SoloMining        bool          `yaml:"solo_mining"`
-	BlockWaitTime     time.Duration `yaml:"block_wait_time"`
-	MinShareDiff      float64       `yaml:"min_share_diff"`
-	VarDiff           bool          `yaml:"var_diff"`
-	SharesPerMin      uint          `yaml:"shares_per_min"`
-	VarDiffStats      bool          `yaml:"var_diff_stats"`
-	ExtranonceSize    uint          `yaml:"extranonce_size"`
-	MineWhenNotSynced bool          `yaml:"mine_when_not_synced"`
-	Poll              int64         `yaml:"poll"`
-	Vote              int64         `yaml:"vote"`
+	StratumPort       string         `yaml:"stratum_port"`
+	StratumNetwork    string         `yaml:"stratum_network"`
+	RPCServer         string         `yaml:"hoosat_address"`
+	PromPort          string         `yaml:"prom_port"`
+	PrintStats        bool           `yaml:"print_stats"`
+	UseLogFile        bool           `yaml:"log_to_file"`
+	HealthCheckPort   string         `yaml:"health_check_port"`
+	SoloMining        bool           `yaml:"solo_mining"`
+	BlockWaitTime     time.Duration  `yaml:"block_wait_time"`
+	MinShareDiff      float64        `yaml:"min_share_diff"`
+	VarDiff           bool           `yaml:"var_diff"`
+	SharesPerMin      uint           `yaml:"shares_per_min"`
+	VarDiffStats      bool           `yaml:"var_diff_stats"`
+	ExtranonceSize    uint           `yaml:"extranonce_size"`
+	MineWhenNotSynced bool           `yaml:"mine_when_not_synced"`
+	Poll              int64          `yaml:"poll"`
+	Vote              int64          `yaml:"vote"`
+	StratumTLSPort    string         `yaml:"stratum_tls_port"`
+	TLSCertFile       string         `yaml:"tls_cert_file"`
+	TLSKeyFile        string         `yaml:"tls_key_file"`
+	TLSClientCAFile   string         `yaml:"tls_client_ca_file"`
+	TLSRequireClient  bool           `yaml:"tls_require_client_cert"`
+	ProxyProtocol     bool           `yaml:"proxy_protocol"`
+	ProxyTrustedCIDRs []string       `yaml:"proxy_trusted_cidrs"`
+	MaxConnections    int            `yaml:"max_connections"`
+	MaxConnectionsIP  int            `yaml:"max_connections_per_ip"`
+	ConnectRatePerIP  float64        `yaml:"connection_rate_per_ip"`
+	ConnectBurstPerIP int            `yaml:"connection_burst_per_ip"`
+	BanDuration       time.Duration  `yaml:"ban_duration"`
+	BanInvalidRatio   float64        `yaml:"ban_invalid_share_ratio"`
+	BanMinShares      int64          `yaml:"ban_min_shares"`
+	BanMaxMalformed   int64          `yaml:"ban_max_malformed"`
+	BanFile           string         `yaml:"ban_file"`
+	BanWallets        []string       `yaml:"ban_wallets"`
+	SubscribeTimeout  time.Duration  `yaml:"subscribe_timeout"`
+	AuthorizeTimeout  time.Duration  `yaml:"authorize_timeout"`
+	IdleTimeout       time.Duration  `yaml:"idle_timeout"`
+	WriteQueueDepth   int            `yaml:"write_queue_depth"`
+	ShutdownTimeout   time.Duration  `yaml:"shutdown_timeout"`
+	ReconnectHost     string         `yaml:"reconnect_host"`
+	ReconnectPort     string         `yaml:"reconnect_port"`
+	MinerProfiles     []MinerProfile `yaml:"miner_profiles"`
+	ExtranoncePinning bool           `yaml:"extranonce_pinning"`
+	ExtranoncePinTTL  time.Duration  `yaml:"extranonce_pin_ttl"`
+	EnforceExtranonce bool           `yaml:"enforce_extranonce"`
+	ExtranonceStrikes int            `yaml:"extranonce_violation_limit"`
+	SessionGrace      time.Duration  `yaml:"session_grace"`
+	// replaces stratum_port with several listeners each with their own
+	// difficulty and mining policy
+	StratumPorts     []StratumPortConfig `yaml:"stratum_ports"`
+	TemplateCacheTTL time.Duration       `yaml:"template_cache_ttl"`
+	LocalCoinbase    bool                `yaml:"local_coinbase"`
+	JobWorkers       int                 `yaml:"job_workers"`
+	// how long template notifications can be silent before polling
+	NotificationTimeout time.Duration `yaml:"block_notification_timeout"`
+	// how far the chain may move past a job before its shares are stale,
+	// in blue score or, if stale_window_time is set, in time
+	StaleWindowBlueScore uint64        `yaml:"stale_window_blue_score"`
+	StaleWindowTime      time.Duration `yaml:"stale_window_time"`
+	// how deep in blue score a submitted block's fate is followed, and how
+	// long the node may not know it before it's considered never accepted
+	BlockConfirmations uint64        `yaml:"block_confirmations"`
+	BlockAcceptTimeout time.Duration `yaml:"block_accept_timeout"`
+	// which difficulty shares on jobs sent before a difficulty change are
+	// held to: job, current or a duration after the change
+	ShareDiffGrace string `yaml:"share_diff_grace"`
+	// how many recent shares are remembered to reject resubmissions
+	ShareFilterSize int `yaml:"share_filter_size"`
 }
 
 func configureZap(cfg BridgeConfig) (*zap.SugaredLogger, func()) {
@@ -75,6 +133,22 @@ func ListenAndServe(cfg BridgeConfig) error {
 	if err != nil {
 		return err
 	}
+	if cfg.TemplateCacheTTL > 0 {
+		htnApi.templates.ttl = cfg.TemplateCacheTTL
+	}
+	if cfg.LocalCoinbase {
+		htnApi.coinbase = newCoinbaseBuilder()
+	}
+	if cfg.NotificationTimeout > 0 {
+		htnApi.notifier = newBlockNotifier(cfg.NotificationTimeout)
+	}
+	blocks := newBlockTracker(htnApi.lookupBlock, htnApi.tip)
+	if cfg.BlockConfirmations > 0 {
+		blocks.confirmations = cfg.BlockConfirmations
+	}
+	if cfg.BlockAcceptTimeout > 0 {
+		blocks.acceptTimeout = cfg.BlockAcceptTimeout
+	}
 
 	if cfg.HealthCheckPort != "" {
 		logger.Info("enabling health check on port " + cfg.HealthCheckPort)
@@ -83,45 +157,150 @@ func ListenAndServe(cfg BridgeConfig) error {
 		})
 
 		registerMinerRewardsHandlers(htnApi) // <- New Rewards handler
+		registerBlockTrackerHandlers(blocks)
 
 		go http.ListenAndServe(cfg.HealthCheckPort, nil)
 	}
 
-	shareHandler := newShareHandler(htnApi.hoosat)
-	minDiff := cfg.MinShareDiff
-	if minDiff == 0 {
-		minDiff = 4
+	bans := newBanManager(BanConfig{
+		Duration:          cfg.BanDuration,
+		InvalidShareRatio: cfg.BanInvalidRatio,
+		MinShares:         cfg.BanMinShares,
+		MaxMalformed:      cfg.BanMaxMalformed,
+		File:              cfg.BanFile,
+		Wallets:           cfg.BanWallets,
+	}, logger)
+	shareHandler := newShareHandler(htnApi.hoosat, bans)
+	shareHandler.enforceExtranonce = cfg.EnforceExtranonce
+	shareHandler.tip = htnApi.tip
+	shareHandler.blocks = blocks
+	if cfg.ShareFilterSize > 0 {
+		shareHandler.dupes = newShareFilter(cfg.ShareFilterSize)
+	}
+	shareHandler.diffGrace, err = parseDiffGrace(cfg.ShareDiffGrace)
+	if err != nil {
+		return errors.Wrap(err, "invalid share_diff_grace config")
+	}
+	if cfg.StaleWindowBlueScore > 0 {
+		shareHandler.staleWindow.blueScore = cfg.StaleWindowBlueScore
+	}
+	shareHandler.staleWindow.duration = cfg.StaleWindowTime
+	shareHandler.maxExtranonceViolations = cfg.ExtranonceStrikes
+	if cfg.ExtranonceStrikes == 0 {
+		shareHandler.maxExtranonceViolations = defaultExtranonceStrikes
+	}
+	profiles, err := newMinerProfiles(cfg.MinerProfiles)
+	if err != nil {
+		return errors.Wrap(err, "invalid miner_profiles config")
 	}
-	extranonceSize := cfg.ExtranonceSize
-	if extranonceSize > 3 {
-		extranonceSize = 3
+	ports, err := resolvePorts(cfg, profiles)
+	if err != nil {
+		return errors.Wrap(err, "invalid stratum_ports config")
+	}
+	clientHandler := newClientListener(logger, shareHandler, bans, profiles)
+	bans.onBan = clientHandler.disconnectBanned
+	if cfg.JobWorkers > 0 {
+		clientHandler.jobs = newJobDistributor(cfg.JobWorkers)
+	}
+	if cfg.SessionGrace > 0 {
+		clientHandler.sessions = newSessionStore(cfg.SessionGrace)
 	}
-	clientHandler := newClientListener(logger, shareHandler, minDiff, int8(extranonceSize))
 	handlers := gostratum.DefaultHandlers()
+	handlers[string(gostratum.StratumMethodSubscribe)] =
+		func(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent) error {
+			// the profile decides whether the miner gets an extranonce, so it
+			// has to be picked before the subscribe response goes out
+			app, session := gostratum.ParseSubscribeParams(event)
+			ctx.RemoteApp = app
+			resumed := clientHandler.resumeSession(ctx, session)
+			clientHandler.assignProfile(ctx)
+			if err := gostratum.HandleSubscribe(ctx, event); err != nil {
+				return err
+			}
+			if state := GetMiningState(ctx); resumed && state.stratumDiff != nil {
+				// the difficulty is only sent when it changes, so tell the
+				// new connection about the one it's resuming with
+				sendClientDiff(ctx, state)
+			}
+			return nil
+		}
+	// check bans before letting the default handler authorize the client
+	handlers[string(gostratum.StratumMethodAuthorize)] =
+		func(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent) error {
+			wallet, worker, err := gostratum.ParseAuthorizeParams(event)
+			if err != nil {
+				bans.RecordMalformed(ctx)
+				return err
+			}
+			if ban, banned := bans.Banned(ctx.RemoteAddr, wallet); banned {
+				ctx.ReplyBanned(event.Id, banMessage(ban))
+				return fmt.Errorf("client banned: %s", banMessage(ban))
+			}
+			clientHandler.pinExtranonce(ctx, wallet, worker)
+			return gostratum.HandleAuthorize(ctx, event)
+		}
 	// override the submit handler with an actual useful handler
 	handlers[string(gostratum.StratumMethodSubmit)] =
 		func(ctx *gostratum.StratumContext, event gostratum.JsonRpcEvent) error {
-			if err := shareHandler.HandleSubmit(ctx, event, cfg.SoloMining); err != nil {
+			if err := shareHandler.HandleSubmit(ctx, event, GetMiningState(ctx).Port().soloMining); err != nil {
 				fmt.Printf("Error handling submit: %s", err)
 			}
 			return nil
 		}
 
-	stratumConfig := gostratum.StratumListenerConfig{
-		Port:           cfg.StratumPort,
-		HandlerMap:     handlers,
-		StateGenerator: MiningStateGenerator,
-		ClientListener: clientHandler,
-		Logger:         logger.Desugar(),
+	authorizeTimeout := cfg.AuthorizeTimeout
+	if authorizeTimeout == 0 {
+		authorizeTimeout = defaultAuthorizeTimeout
+	}
+
+	// one limiter for every port, the limits are for the bridge as a whole
+	limiter := gostratum.NewConnectionLimiter(gostratum.ConnectionLimits{
+		MaxConnections:      cfg.MaxConnections,
+		MaxConnectionsPerIP: cfg.MaxConnectionsIP,
+		ConnectRatePerIP:    cfg.ConnectRatePerIP,
+		ConnectBurstPerIP:   cfg.ConnectBurstPerIP,
+	})
+	listeners := make([]*gostratum.StratumListener, 0, len(ports))
+	runVardiff := false
+	for i, port := range ports {
+		stratumConfig := gostratum.StratumListenerConfig{
+			Port:              port.name,
+			Network:           cfg.StratumNetwork,
+			HandlerMap:        handlers,
+			StateGenerator:    port.stateGenerator,
+			ClientListener:    clientHandler,
+			Logger:            logger.Desugar(),
+			ProxyProtocol:     cfg.ProxyProtocol,
+			ProxyTrustedCIDRs: cfg.ProxyTrustedCIDRs,
+			SubscribeTimeout:  cfg.SubscribeTimeout,
+			AuthorizeTimeout:  authorizeTimeout,
+			IdleTimeout:       cfg.IdleTimeout,
+			WriteQueueDepth:   cfg.WriteQueueDepth,
+			Limiter:           limiter,
+		}
+		// the tls listener shares the policy of the first port
+		if i == 0 && cfg.StratumTLSPort != "" {
+			stratumConfig.TLS = &gostratum.TLSConfig{
+				Port:              cfg.StratumTLSPort,
+				CertFile:          cfg.TLSCertFile,
+				KeyFile:           cfg.TLSKeyFile,
+				ClientCAFile:      cfg.TLSClientCAFile,
+				RequireClientCert: cfg.TLSRequireClient,
+			}
+		}
+		listeners = append(listeners, gostratum.NewListener(stratumConfig))
+		runVardiff = runVardiff || port.varDiff || port.soloMining
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	htnApi.Start(ctx, cfg, func() {
-		clientHandler.NewBlockAvailable(htnApi, cfg.SoloMining, cfg.Poll, cfg.Vote)
+	htnApi.Start(ctx, cfg, func(notified time.Time) {
+		clientHandler.NewBlockAvailable(htnApi, notified, cfg.Poll, cfg.Vote)
 	})
 
-	if cfg.VarDiff || cfg.SoloMining {
+	go blocks.Run(ctx)
+
+	if runVardiff {
 		go shareHandler.startVardiffThread(cfg.SharesPerMin, cfg.VarDiffStats)
 	}
 
@@ -129,5 +308,55 @@ func ListenAndServe(cfg BridgeConfig) error {
 		go shareHandler.startStatsThread()
 	}
 
-	return gostratum.NewListener(stratumConfig).Listen(context.Background())
+	// the server context outlives the shutdown signal so connected miners keep
+	// getting jobs while they're being moved off
+	shutdown, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	listenErr := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener *gostratum.StratumListener) {
+			listenErr <- listener.Listen(ctx)
+		}(listener)
+	}
+
+	select {
+	case err := <-listenErr:
+		// one port failing takes the rest down with it
+		cancel()
+		for range listeners[1:] {
+			<-listenErr
+		}
+		return err
+	case <-shutdown.Done():
+	}
+	stopSignals() // a second signal kills the process outright
+
+	shutdownTimeout := cfg.ShutdownTimeout
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = defaultShutdownTimeout
+	}
+	deadline := time.Now().Add(shutdownTimeout)
+	logger.Info("shutting down, no longer accepting connections")
+	for _, listener := range listeners {
+		listener.StopAccepting()
+	}
+	clientHandler.broadcastReconnect(cfg.ReconnectHost, cfg.ReconnectPort)
+	if remaining := clientHandler.waitForClients(deadline); remaining > 0 {
+		logger.Warn(fmt.Sprintf("%d clients still connected after reconnect request", remaining))
+	}
+	if !shareHandler.drainSubmissions(time.Until(deadline)) {
+		logger.Warn("timed out waiting for in-flight submissions")
+	}
+	cancel()
+	var listenFailure error
+	for range listeners {
+		if err := <-listenErr; !errors.Is(err, context.Canceled) && listenFailure == nil {
+			listenFailure = err
+		}
+	}
+	if listenFailure != nil {
+		return listenFailure
+	}
+	logger.Info("shutdown complete")
+	return nil
 }
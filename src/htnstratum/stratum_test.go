@@ -1,17 +1,22 @@
 package htnstratum
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"math/big"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/Hoosat-Oy/HTND/app/appmessage"
 	"github.com/Hoosat-Oy/HTND/util/difficulty"
+	"github.com/Hoosat-Oy/htn-stratum-bridge/src/gostratum"
 	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap"
 )
 
 func TestHeaderSerialization(t *testing.T) {
@@ -75,6 +80,103 @@ func TestPoolHzCalculation(t *testing.T) {
 	log.Println(difficulty.GetHashrateString(&rate, time.Second*1))
 }
 
+func TestDrainSubmissions(t *testing.T) {
+	sh := newShareHandler(nil, nil)
+	sh.beginSubmit() // a submit still being processed
+	if sh.drainSubmissions(50 * time.Millisecond) {
+		t.Fatalf("drained with a submission in flight")
+	}
+	// a timed out drain doesn't hold up anything that follows
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	refused := make(chan error, 1)
+	go func() { refused <- sh.HandleSubmit(ctx, gostratum.JsonRpcEvent{Id: 7}, false) }()
+	response := gostratum.JsonRpcResponse{}
+	mc.ReadTestDataFromBuffer(func(b []byte) {
+		if err := json.Unmarshal(b, &response); err != nil {
+			t.Fatalf("failed decoding %s: %s", b, err)
+		}
+	})
+	select {
+	case err := <-refused:
+		if err != nil {
+			t.Fatalf("submit while draining failed: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("submit blocked while draining")
+	}
+	if response.Id != float64(7) || response.Error == nil {
+		t.Fatalf("expected an error reply to the submit, got %+v", response)
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("client disconnected while draining")
+	}
+
+	sh.endSubmit()
+	if !sh.drainSubmissions(time.Second) {
+		t.Fatalf("failed draining after submission finished")
+	}
+}
+
+func TestExtranonceEnforcement(t *testing.T) {
+	for _, tc := range []struct {
+		nonce, extranonce string
+		valid             bool
+	}{
+		{"0a00000000000123", "0a", true},
+		{"0A00000000000123", "0a", true},
+		{"0b00000000000123", "0a", false},
+		{"123", "0a", false},
+		{"123", "00", true}, // short nonces are zero padded
+		{"ffffffffffffffff", "", true},
+	} {
+		if valid := nonceInExtranonce(tc.nonce, tc.extranonce); valid != tc.valid {
+			t.Errorf("nonce %s extranonce %s: expected %t", tc.nonce, tc.extranonce, tc.valid)
+		}
+	}
+
+	sh := newShareHandler(nil, nil)
+	sh.enforceExtranonce = true
+	sh.maxExtranonceViolations = 2
+	ctx, mc := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	go func() {
+		for ctx.Err() == nil {
+			mc.ReadTestDataFromBuffer(func([]byte) {})
+		}
+	}()
+	ctx.Extranonce = "0a"
+	state := GetMiningState(ctx)
+	jobId := state.AddJob(&appmessage.RPCBlock{})
+	submit := gostratum.NewEvent("1", "mining.submit", []any{
+		"wallet.worker", fmt.Sprintf("%d", jobId), "0b00000000000123", strings.Repeat("0", 64),
+	})
+	for i := 0; i < 2; i++ {
+		if err := sh.HandleSubmit(ctx, submit, false); err != nil {
+			t.Fatalf("submit failed: %s", err)
+		}
+	}
+	if sh.overall.InvalidShares.Load() != 2 {
+		t.Fatalf("expected 2 invalid shares, got %d", sh.overall.InvalidShares.Load())
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("client not disconnected after repeated violations")
+	}
+
+	// profiles can opt out
+	optOut, _ := gostratum.NewMockContext(context.Background(), zap.NewNop(), MiningStateGenerator())
+	optOut.Extranonce = "0a"
+	state = GetMiningState(optOut)
+	state.profile = &MinerProfile{NoExtranonceCheck: true}
+	state.AddJob(&appmessage.RPCBlock{Header: &appmessage.RPCBlockHeader{}})
+	if err := sh.HandleSubmit(optOut, submit, false); err != nil {
+		t.Fatalf("opted out submit failed: %s", err)
+	}
+	if state.extranonceViolations != 0 {
+		t.Fatalf("extranonce checked despite profile opt out")
+	}
+}
+
 // snooper. Inspect coms between miner and pool
 func TestBridge(t *testing.T) {
 	serverConn, err := net.Dial("tcp", "pool.us.woolypooly.com:3112")
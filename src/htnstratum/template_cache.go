@@ -0,0 +1,93 @@
+package htnstratum
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Hoosat-Oy/HTND/app/appmessage"
+)
+
+const defaultTemplateCacheTTL = 500 * time.Millisecond
+
+type templateFetcher func(wallet string, payload string) (*appmessage.GetBlockTemplateResponseMessage, error)
+
+type templateKey struct {
+	wallet  string
+	payload string
+}
+
+// templateFetch is a template request to the node, shared by every client
+// asking for the same key while it's in flight and afterwards while cached
+type templateFetch struct {
+	done     chan struct{}
+	fetched  time.Time
+	template *appmessage.GetBlockTemplateResponseMessage
+	err      error
+}
+
+// templateCache fetches the template for each distinct (wallet, payload) once
+// per block event and hands the same template to every client sharing the
+// key. Templates are dropped on the next block event or after the ttl,
+// whichever comes first
+type templateCache struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	entries map[templateKey]*templateFetch
+	fetch   templateFetcher
+	clock   func() time.Time
+}
+
+func newTemplateCache(ttl time.Duration, fetch templateFetcher) *templateCache {
+	return &templateCache{
+		ttl:     ttl,
+		entries: map[templateKey]*templateFetch{},
+		fetch:   fetch,
+		clock:   time.Now,
+	}
+}
+
+// NewEvent marks a new block template being available, so following
+// requests go to the node again
+func (tc *templateCache) NewEvent() {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	// anything in flight finishes for the clients already waiting on it
+	tc.entries = map[templateKey]*templateFetch{}
+}
+
+// Get returns the template for the key, fetching it only if no request for
+// it was made since the last block event
+func (tc *templateCache) Get(wallet string, payload string) (*appmessage.GetBlockTemplateResponseMessage, error) {
+	key := templateKey{wallet: wallet, payload: payload}
+	tc.lock.Lock()
+	if entry, exists := tc.entries[key]; exists {
+		select {
+		case <-entry.done:
+			if tc.clock().Sub(entry.fetched) <= tc.ttl {
+				tc.lock.Unlock()
+				RecordTemplateRequest(templateCached)
+				return entry.template, nil
+			}
+		default:
+			tc.lock.Unlock()
+			<-entry.done
+			RecordTemplateRequest(templateShared)
+			return entry.template, entry.err
+		}
+	}
+	entry := &templateFetch{done: make(chan struct{})}
+	tc.entries[key] = entry
+	tc.lock.Unlock()
+
+	RecordTemplateRequest(templateFetched)
+	entry.template, entry.err = tc.fetch(wallet, payload)
+	tc.lock.Lock()
+	entry.fetched = tc.clock()
+	if entry.err != nil && tc.entries[key] == entry {
+		// don't hold on to failures, the next client tries again
+		delete(tc.entries, key)
+	}
+	tc.lock.Unlock()
+	close(entry.done)
+	return entry.template, entry.err
+}
@@ -0,0 +1,84 @@
+package htnstratum
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Hoosat-Oy/HTND/app/appmessage"
+)
+
+func TestTemplateCache(t *testing.T) {
+	var fetches int32
+	release := make(chan struct{})
+	failing := false
+	tc := newTemplateCache(time.Second, func(wallet string, payload string) (*appmessage.GetBlockTemplateResponseMessage, error) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		if failing {
+			return nil, fmt.Errorf("node unavailable")
+		}
+		return &appmessage.GetBlockTemplateResponseMessage{Block: &appmessage.RPCBlock{}}, nil
+	})
+	now := time.Now()
+	tc.clock = func() time.Time { return now }
+
+	// concurrent requests for the same key make a single rpc
+	const clients = 20
+	results := make([]*appmessage.GetBlockTemplateResponseMessage, clients)
+	wg := sync.WaitGroup{}
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = tc.Get("hoosat:wallet", "rig")
+		}(i)
+	}
+	for atomic.LoadInt32(&fetches) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if fetches != 1 {
+		t.Fatalf("expected 1 fetch for %d clients, got %d", clients, fetches)
+	}
+	for _, r := range results {
+		if r == nil || r != results[0] {
+			t.Fatalf("clients didn't share the same template")
+		}
+	}
+
+	// served from cache for the rest of the block, other keys are fetched
+	if cached, _ := tc.Get("hoosat:wallet", "rig"); cached != results[0] || fetches != 1 {
+		t.Fatalf("expected cached template, %d fetches", fetches)
+	}
+	tc.Get("hoosat:wallet", "other rig")
+	tc.Get("hoosat:other", "rig")
+	if fetches != 3 {
+		t.Fatalf("expected distinct keys to be fetched, got %d fetches", fetches)
+	}
+
+	// a new block or the ttl passing fetches again
+	tc.NewEvent()
+	if fresh, _ := tc.Get("hoosat:wallet", "rig"); fresh == results[0] || fetches != 4 {
+		t.Fatalf("expected a fresh template after a block event, %d fetches", fetches)
+	}
+	now = now.Add(2 * time.Second)
+	tc.Get("hoosat:wallet", "rig")
+	if fetches != 5 {
+		t.Fatalf("expected a fresh template after the ttl, %d fetches", fetches)
+	}
+
+	// failures aren't cached
+	failing = true
+	tc.NewEvent()
+	if _, err := tc.Get("hoosat:wallet", "rig"); err == nil {
+		t.Fatalf("expected fetch error")
+	}
+	failing = false
+	if template, err := tc.Get("hoosat:wallet", "rig"); err != nil || template == nil || fetches != 7 {
+		t.Fatalf("expected retry after a failure, %d fetches, err %v", fetches, err)
+	}
+}